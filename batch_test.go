@@ -0,0 +1,83 @@
+package ringman
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_BatchMembership(t *testing.T) {
+	Convey("Batch membership changes", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal", "kjartan"})
+		ringMgr.Start()
+
+		events := make(chan RingEvent, 10)
+		ringMgr.Subscribe(events)
+
+		Convey("SetNodes() replaces the membership in one version", func() {
+			err := ringMgr.SetNodes(map[string]int{"kjartan": 2, "gunnar": 1, "hallgerd": 0})
+			So(err, ShouldBeNil)
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Version, ShouldEqual, 1)
+			So(snap.Weights(), ShouldResemble, map[string]int{
+				"kjartan": 2, "gunnar": 1, "hallgerd": DefaultNodeWeight,
+			})
+
+			// One event per node, sharing the version
+			So(len(events), ShouldEqual, 4)
+			for i := 0; i < 4; i++ {
+				So((<-events).Version, ShouldEqual, 1)
+			}
+		})
+
+		Convey("SetNodes() with the same nodes changes nothing", func() {
+			ringMgr.SetNodes(map[string]int{"njal": 1, "kjartan": 1})
+			So(ringMgr.Version(), ShouldEqual, 0)
+			So(len(events), ShouldEqual, 0)
+		})
+
+		Convey("SetNodes() forgets what it knew about removed nodes", func() {
+			ringMgr.AddNodeWithLocation("njal", 1, Location{Zone: "a"})
+			ringMgr.SetDraining("njal", true)
+
+			ringMgr.SetNodes(map[string]int{"kjartan": 1})
+			ringMgr.SetNodes(map[string]int{"kjartan": 1, "njal": 1})
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.IsDraining("njal"), ShouldBeFalse)
+			So(snap.Location("njal"), ShouldResemble, Location{})
+		})
+
+		Convey("ApplyDiff() adds and removes in one version", func() {
+			err := ringMgr.ApplyDiff(map[string]int{"gunnar": 3, "kjartan": 2}, []string{"njal", "hallgerd"})
+			So(err, ShouldBeNil)
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Version, ShouldEqual, 1)
+			So(snap.Weights(), ShouldResemble, map[string]int{"kjartan": 2, "gunnar": 3})
+
+			evt := <-events
+			So(evt.Type, ShouldEqual, NodeRemoved)
+			So(evt.Node, ShouldEqual, "njal")
+		})
+
+		Convey("ApplyDiff() keeps a node that is both removed and added", func() {
+			ringMgr.ApplyDiff(map[string]int{"njal": 5}, []string{"njal"})
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Weights()["njal"], ShouldEqual, 5)
+		})
+
+		Convey("the caller's map can be changed afterward", func() {
+			nodes := map[string]int{"gunnar": 1}
+			ringMgr.SetNodes(nodes)
+			nodes["hallgerd"] = 1
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Size(), ShouldEqual, 1)
+		})
+
+		Reset(func() { ringMgr.Stop() })
+	})
+}
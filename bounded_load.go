@@ -0,0 +1,173 @@
+package ringman
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// loadTracker holds the load callers report for each node, for consistent
+// hashing with bounded loads (Mirrokni, Thorup and Zadimoghaddam). Reports
+// and lookups are frequent, so the counters are updated atomically and the
+// map of them is only replaced when a node is seen for the first time. The
+// total is kept up to date alongside them, so lookups needn't add it up.
+type loadTracker struct {
+	sync.Mutex              // Only held while replacing the counters map
+	counters   atomic.Value // Always holds a map[string]*int64
+	total      int64        // The sum of every node's load
+	epsilon    uint64       // The float64 bits of epsilon, 0 when disabled
+}
+
+// counter returns the load counter for the node, creating it if needed.
+func (l *loadTracker) counter(node string) *int64 {
+	counters, _ := l.counters.Load().(map[string]*int64)
+	if counter, ok := counters[node]; ok {
+		return counter
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// Someone may have beaten us to it
+	counters, _ = l.counters.Load().(map[string]*int64)
+	if counter, ok := counters[node]; ok {
+		return counter
+	}
+
+	replacement := make(map[string]*int64, len(counters)+1)
+	for name, counter := range counters {
+		replacement[name] = counter
+	}
+	counter := new(int64)
+	replacement[node] = counter
+	l.counters.Store(replacement)
+
+	return counter
+}
+
+// load returns the current load of the node.
+func (l *loadTracker) load(node string) int64 {
+	counters, _ := l.counters.Load().(map[string]*int64)
+	if counter, ok := counters[node]; ok {
+		return atomic.LoadInt64(counter)
+	}
+
+	return 0
+}
+
+// add adds delta to the load of the node and returns its new load.
+func (l *loadTracker) add(node string, delta int64) int64 {
+	load := atomic.AddInt64(l.counter(node), delta)
+	atomic.AddInt64(&l.total, delta)
+
+	return load
+}
+
+// set replaces the load of the node.
+func (l *loadTracker) set(node string, load int64) {
+	previous := atomic.SwapInt64(l.counter(node), load)
+	atomic.AddInt64(&l.total, load-previous)
+}
+
+// getEpsilon returns epsilon, or 0 if bounded loads are disabled.
+func (l *loadTracker) getEpsilon() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&l.epsilon))
+}
+
+// boundedNode picks the owner for the key from the snapshot. Nodes are tried
+// in the placement's own ring order, not spread across zones, and the first
+// one with room to spare wins. A node has room while its load is under
+// (1+epsilon) times its share of the total load, counting the request being
+// placed. Shares are proportional to weight.
+//
+// The owner almost always has room, so we only ask the placement for more
+// candidates once it doesn't, and then a few more at a time.
+func (l *loadTracker) boundedNode(snap *RingSnapshot, key string, epsilon float64) (string, error) {
+	owner, ok := snap.placement.GetNode(key)
+	if !ok {
+		return "", ErrNoNodes
+	}
+
+	totalLoad := atomic.LoadInt64(&l.total)
+	hasRoom := func(node string) bool {
+		share := float64(totalLoad+1) * float64(snap.weights[node]) / float64(snap.totalWeight)
+		return float64(l.load(node)) < math.Ceil((1+epsilon)*share)
+	}
+
+	if hasRoom(owner) {
+		return owner, nil
+	}
+
+	checked := 1
+	for count := 2; checked < snap.Size(); count *= 2 {
+		candidates, _ := snap.placement.GetNodes(key, count)
+		if len(candidates) <= checked {
+			break
+		}
+
+		for _, node := range candidates[checked:] {
+			if hasRoom(node) {
+				return node, nil
+			}
+		}
+		checked = len(candidates)
+	}
+
+	// Every node is at capacity, which only happens when some loads have
+	// gone negative. Fall back to the owner.
+	return owner, nil
+}
+
+// SetBoundedLoad turns on consistent hashing with bounded loads. GetNode will
+// skip over a node once its load reaches (1+epsilon) times its fair share of
+// the total load, and return the next node in ring order instead. Smaller
+// values of epsilon keep loads more even but move more keys away from their
+// owners. An epsilon of 0 turns bounded loads off again.
+//
+// The HashRingManager does not count load itself. Callers report it for each
+// node with AddLoad or SetLoad. The total includes load reported for nodes
+// that have since left the ring, so set theirs back to 0 when they go.
+func (r *HashRingManager) SetBoundedLoad(epsilon float64) error {
+	if r == nil {
+		return ErrNilManager
+	}
+
+	if epsilon < 0 || math.IsNaN(epsilon) || math.IsInf(epsilon, 0) {
+		return errors.New("Bounded load epsilon must be 0 or more")
+	}
+
+	atomic.StoreUint64(&r.loads.epsilon, math.Float64bits(epsilon))
+	return nil
+}
+
+// AddLoad adds delta to the load for the node and returns the new load. This
+// is handy for tracking in-flight requests: add 1 when sending a request to
+// the node returned by GetNode and add -1 when it completes.
+func (r *HashRingManager) AddLoad(node string, delta int64) (int64, error) {
+	if r == nil {
+		return 0, ErrNilManager
+	}
+
+	return r.loads.add(node, delta), nil
+}
+
+// SetLoad replaces the load for the node, e.g. with a figure the node itself
+// reports.
+func (r *HashRingManager) SetLoad(node string, load int64) error {
+	if r == nil {
+		return ErrNilManager
+	}
+
+	r.loads.set(node, load)
+	return nil
+}
+
+// Load returns the last load reported for the node.
+func (r *HashRingManager) Load(node string) int64 {
+	if r == nil {
+		return 0
+	}
+
+	return r.loads.load(node)
+}
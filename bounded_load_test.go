@@ -0,0 +1,187 @@
+package ringman
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_BoundedLoad(t *testing.T) {
+	Convey("Bounded loads", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal", "kjartan", "gunnar"})
+		owner, _ := ringMgr.GetNode("foo")
+
+		Convey("are off by default", func() {
+			ringMgr.SetLoad(owner, 1000)
+
+			node, err := ringMgr.GetNode("foo")
+			So(err, ShouldBeNil)
+			So(node, ShouldEqual, owner)
+		})
+
+		Convey("reject a bad epsilon", func() {
+			So(ringMgr.SetBoundedLoad(-1), ShouldNotBeNil)
+			So(ringMgr.SetBoundedLoad(math.NaN()), ShouldNotBeNil)
+		})
+
+		Convey("track load reported by callers", func() {
+			load, err := ringMgr.AddLoad("njal", 2)
+			So(err, ShouldBeNil)
+			So(load, ShouldEqual, 2)
+
+			ringMgr.AddLoad("njal", -1)
+			So(ringMgr.Load("njal"), ShouldEqual, 1)
+
+			ringMgr.SetLoad("njal", 7)
+			So(ringMgr.Load("njal"), ShouldEqual, 7)
+			So(ringMgr.Load("hallgerd"), ShouldEqual, 0)
+		})
+
+		Convey("when enabled", func() {
+			So(ringMgr.SetBoundedLoad(0.25), ShouldBeNil)
+			replicas, _ := ringMgr.GetNodes("foo", 3)
+
+			Convey("return the owner while it has room", func() {
+				node, err := ringMgr.GetNode("foo")
+				So(err, ShouldBeNil)
+				So(node, ShouldEqual, owner)
+			})
+
+			Convey("skip an overloaded owner for the next node in the ring", func() {
+				ringMgr.SetLoad(owner, 10)
+
+				node, err := ringMgr.GetNode("foo")
+				So(err, ShouldBeNil)
+				So(node, ShouldEqual, replicas[1])
+			})
+
+			Convey("put the node GetNode picks first among the replicas", func() {
+				ringMgr.SetLoad(owner, 10)
+				node, _ := ringMgr.GetNode("foo")
+
+				nodes, err := ringMgr.GetNodes("foo", 3)
+				So(err, ShouldBeNil)
+				So(nodes, ShouldResemble, []string{node, owner, replicas[2]})
+
+				infos, err := ringMgr.GetNodesInfo("foo", 2)
+				So(err, ShouldBeNil)
+				So(infos[0].ID, ShouldEqual, node)
+				So(infos[1].ID, ShouldEqual, owner)
+
+				recorder := httptest.NewRecorder()
+				httpGetNode(recorder, httptest.NewRequest("GET", "/nodes/get?key=foo&replicas=2", nil), ringMgr, "foo")
+				So(recorder.Body.String(), ShouldContainSubstring, `"Node": "`+node+`"`)
+			})
+
+			Convey("keep every node under the bound for a hot key", func() {
+				for i := 0; i < 300; i++ {
+					node, _ := ringMgr.GetNode("hot-key")
+					ringMgr.AddLoad(node, 1)
+				}
+
+				for _, node := range []string{"njal", "kjartan", "gunnar"} {
+					So(ringMgr.Load(node), ShouldBeLessThanOrEqualTo, math.Ceil(1.25*100))
+				}
+			})
+
+			Convey("spread load by weight", func() {
+				weighted := NewWeightedHashRingManager(map[string]int{"njal": 1, "kjartan": 3})
+				weighted.SetBoundedLoad(0.25)
+
+				for i := 0; i < 400; i++ {
+					node, _ := weighted.GetNode(fmt.Sprintf("key-%d", i%3))
+					weighted.AddLoad(node, 1)
+				}
+
+				So(weighted.Load("njal"), ShouldBeLessThanOrEqualTo, math.Ceil(1.25*100))
+				So(weighted.Load("kjartan"), ShouldBeLessThanOrEqualTo, math.Ceil(1.25*300))
+			})
+
+			Convey("skip to the next node in ring order when nodes have zones", func() {
+				weights := map[string]int{"njal": 1, "kjartan": 1, "gunnar": 1, "hallgerd": 1}
+				snap := newRingSnapshot(1, NewHashringPlacement(weights), weights, map[string]Location{
+					"njal": {Zone: "a"}, "kjartan": {Zone: "a"}, "gunnar": {Zone: "b"}, "hallgerd": {Zone: "b"},
+				})
+
+				// Find a key whose next node in the ring is in the owner's zone,
+				// so it isn't the next one GetNodes spreads to
+				var key string
+				var ringOrder []string
+				for i := 0; ; i++ {
+					key = fmt.Sprintf("key-%d", i)
+					ringOrder, _ = snap.placement.GetNodes(key, 4)
+					spread, _ := snap.GetNodes(key, 4)
+					if spread[1] != ringOrder[1] {
+						break
+					}
+				}
+
+				var loads loadTracker
+				loads.set(ringOrder[0], 10)
+
+				node, err := loads.boundedNode(snap, key, 0.25)
+				So(err, ShouldBeNil)
+				So(node, ShouldEqual, ringOrder[1])
+			})
+
+			Convey("only walk as far around the ring as they need to", func() {
+				weights := make(map[string]int, 20)
+				for i := 0; i < 20; i++ {
+					weights[fmt.Sprintf("node-%d", i)] = 1
+				}
+				placement := &countingPlacement{Placement: NewHashringPlacement(weights)}
+				snap := newRingSnapshot(1, placement, weights, nil)
+
+				var loads loadTracker
+				owner, _ := placement.GetNode("foo")
+				node, err := loads.boundedNode(snap, "foo", 0.25)
+				So(err, ShouldBeNil)
+				So(node, ShouldEqual, owner)
+				So(placement.asked, ShouldBeEmpty)
+
+				// Fill up the first five nodes in ring order
+				ringOrder, _ := placement.GetNodes("foo", 20)
+				for _, full := range ringOrder[:5] {
+					loads.set(full, 10)
+				}
+				placement.asked = nil
+
+				node, err = loads.boundedNode(snap, "foo", 0.25)
+				So(err, ShouldBeNil)
+				So(node, ShouldEqual, ringOrder[5])
+				So(placement.asked, ShouldResemble, []int{2, 4, 8})
+			})
+
+			Convey("can be turned off again", func() {
+				ringMgr.SetLoad(owner, 10)
+				ringMgr.SetBoundedLoad(0)
+
+				node, _ := ringMgr.GetNode("foo")
+				So(node, ShouldEqual, owner)
+			})
+		})
+
+		Convey("handle a nil manager", func() {
+			var broken *HashRingManager
+			So(broken.SetBoundedLoad(0.25), ShouldEqual, ErrNilManager)
+			So(broken.SetLoad("njal", 1), ShouldEqual, ErrNilManager)
+			_, err := broken.AddLoad("njal", 1)
+			So(err, ShouldEqual, ErrNilManager)
+			So(broken.Load("njal"), ShouldEqual, 0)
+		})
+	})
+}
+
+// countingPlacement records the counts that GetNodes is asked for.
+type countingPlacement struct {
+	Placement
+	asked []int
+}
+
+func (p *countingPlacement) GetNodes(key string, count int) ([]string, bool) {
+	p.asked = append(p.asked, count)
+	return p.Placement.GetNodes(key, count)
+}
@@ -0,0 +1,260 @@
+package ringman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/relistan/go-director"
+)
+
+const (
+	DefaultConsulUrl    = "http://127.0.0.1:8500"
+	ConsulWaitTime      = 5 * time.Minute // How long each blocking query may wait for a change
+	ConsulRetryInterval = 1 * time.Second // How long we wait after a failed query
+)
+
+// A ConsulRing is a ring backed by the health of a service in Consul. It
+// makes blocking queries on the service's health endpoint, and keeps the
+// ring in step with the instances that are passing their checks. Our
+// LocalNode is the instance registered on the Consul node named after our
+// hostname.
+type ConsulRing struct {
+	managedRing
+	consulUrl string
+	svcName   string
+	tag       string
+	svcPort   int
+	client    *http.Client
+	cancel    context.CancelFunc // Stops the watch, and any query in flight
+	lastIndex uint64             // The X-Consul-Index of the last answer
+	hostname  string             // Our own hostname, which is normally our Consul node name
+}
+
+// consulServiceEntry is the part of each entry from /v1/health/service that
+// we use.
+type consulServiceEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Tags    []string
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+// Ensure ConsulRing implements Ring interface
+var _ Ring = (*ConsulRing)(nil)
+
+// NewConsulRing returns a running ConsulRing for the instances of the service
+// that are passing their health checks. If tag is not empty, only instances
+// with the tag are used, and if svcPort is not 0, only instances registered
+// on that port. consulUrl is the address of the Consul HTTP API, or
+// DefaultConsulUrl if it is empty.
+func NewConsulRing(consulUrl string, svcName string, tag string, svcPort int) (*ConsulRing, error) {
+	if consulUrl == "" {
+		consulUrl = DefaultConsulUrl
+	}
+
+	hostname, _ := os.Hostname()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	consulRing := &ConsulRing{
+		consulUrl: strings.TrimSuffix(consulUrl, "/"),
+		svcName:   svcName,
+		tag:       tag,
+		svcPort:   svcPort,
+		client:    &http.Client{Timeout: ConsulWaitTime + 30*time.Second},
+		cancel:    cancel,
+		hostname:  hostname,
+	}
+	consulRing.startManager()
+
+	// Bootstrap, so the ring is ready to use when we return it
+	err := consulRing.refresh(ctx)
+	if err != nil {
+		consulRing.Shutdown()
+		return nil, err
+	}
+
+	// Each pass blocks until the service changes. We only stop on Shutdown.
+	watcher := director.NewFreeLooper(director.FOREVER, nil)
+	go watcher.Loop(func() error {
+		err := consulRing.refresh(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		consulRing.logger.get().Error("Unable to refresh ring from Consul", "service", svcName, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ConsulRetryInterval):
+			return nil
+		}
+	})
+
+	return consulRing, nil
+}
+
+// refresh queries Consul for the passing instances of the service and
+// replaces the membership of the ring with them. After the first query, it
+// blocks until Consul has something newer than what we last saw. Only one
+// refresh must run at once.
+func (r *ConsulRing) refresh(ctx context.Context) error {
+	entries, index, err := r.query(ctx, r.lastIndex)
+	if err != nil {
+		return err
+	}
+
+	// Consul asks that we start over if the index ever goes backwards, and
+	// that we never block on an index of 0. Otherwise query would leave the
+	// index out, get an answer right away, and we'd spin.
+	if index < r.lastIndex {
+		index = 0
+	}
+	if index < 1 {
+		index = 1
+	}
+	r.lastIndex = index
+
+	var localNode string
+	infos := make([]Node, 0, len(entries))
+
+	for _, entry := range entries {
+		info, err := r.nodeForEntry(entry)
+		if err != nil {
+			r.logger.get().Error("Unable to add service to the ring", "service", entry.Service.ID, "error", err)
+			continue
+		}
+		infos = append(infos, info)
+
+		// If there's more than one of us on the host, pick one consistently
+		if entry.Node.Node == r.hostname && (localNode == "" || info.ID < localNode) {
+			localNode = info.ID
+		}
+	}
+
+	// Replace the whole set at once, so the ring is only rebuilt once
+	err = r.manager.SetNodesInfo(infos)
+	if err != nil {
+		return fmt.Errorf("Unable to update ring: %s", err)
+	}
+
+	r.setLocalNode(localNode)
+
+	return nil
+}
+
+// query makes a blocking query on the health endpoint for the service, and
+// returns the passing entries and the index that goes with them. An index
+// of 0 returns straight away.
+func (r *ConsulRing) query(ctx context.Context, index uint64) ([]consulServiceEntry, uint64, error) {
+	params := url.Values{}
+	params.Set("passing", "1")
+	if r.tag != "" {
+		params.Set("tag", r.tag)
+	}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(ConsulWaitTime.Seconds())))
+	}
+
+	reqUrl := r.consulUrl + "/v1/health/service/" + url.PathEscape(r.svcName) + "?" + params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to query Consul: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Unable to query Consul: got status %d!", resp.StatusCode)
+	}
+
+	var entries []consulServiceEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to decode Consul response: %s", err)
+	}
+
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid X-Consul-Index from Consul: %s", err)
+	}
+
+	return entries, newIndex, nil
+}
+
+// nodeForEntry takes a Consul service entry and returns its Node, whose ID
+// is the key we use to store it in the hashring. Like the SidecarRing, it is
+// based on the address and service port. The service's address is used if
+// it has one, otherwise that of the Consul node it is on.
+func (r *ConsulRing) nodeForEntry(entry consulServiceEntry) (Node, error) {
+	if r.svcPort != 0 && entry.Service.Port != r.svcPort {
+		return Node{}, fmt.Errorf(
+			"Can't match service port %d for incoming service %s!",
+			r.svcPort, entry.Service.ID,
+		)
+	}
+
+	address := entry.Service.Address
+	if address == "" {
+		address = entry.Node.Address
+	}
+
+	metadata := copyMetadata(entry.Service.Meta)
+	if metadata == nil {
+		metadata = make(map[string]string, 3)
+	}
+	metadata["service"] = entry.Service.Service
+	metadata["node"] = entry.Node.Node
+
+	if len(entry.Service.Tags) > 0 {
+		tags := append([]string(nil), entry.Service.Tags...)
+		sort.Strings(tags)
+		metadata["tags"] = strings.Join(tags, ",")
+	}
+
+	return Node{
+		ID:       net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)),
+		Name:     entry.Service.ID,
+		Address:  address,
+		Port:     entry.Service.Port,
+		Metadata: metadata,
+	}, nil
+}
+
+// Shutdown stops watching Consul and stops the HashRingManager
+func (r *ConsulRing) Shutdown() {
+	r.shutdown(func() {
+		// Cancelling ends the blocking query, and the watch with it
+		r.cancel()
+
+		r.stopManager()
+	})
+}
@@ -0,0 +1,240 @@
+package ringman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// consulStub stands in for the health endpoint of the Consul API. It
+// supports blocking queries, and only returns passing instances.
+type consulStub struct {
+	sync.Mutex
+	server  *httptest.Server
+	index   uint64
+	changed chan struct{} // Closed when the entries change
+	entries []consulStubEntry
+	queries []string // The raw query of each request
+}
+
+type consulStubEntry struct {
+	node    string
+	id      string
+	address string
+	port    int
+	tags    []string
+	passing bool
+}
+
+func newConsulStub(entries ...consulStubEntry) *consulStub {
+	stub := &consulStub{index: 1, changed: make(chan struct{}), entries: entries}
+	stub.server = httptest.NewServer(http.HandlerFunc(stub.serveHealth))
+	return stub
+}
+
+func (s *consulStub) set(entries ...consulStubEntry) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.entries = entries
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *consulStub) serveHealth(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/health/service/ringman" {
+		http.NotFound(w, req)
+		return
+	}
+
+	s.Lock()
+	s.queries = append(s.queries, req.URL.RawQuery)
+	rawIndex := req.URL.Query().Get("index")
+	index, _ := strconv.ParseUint(rawIndex, 10, 64)
+	changed := s.changed
+	blocking := rawIndex != "" && index >= s.index
+	s.Unlock()
+
+	// Wait for something newer than the caller has
+	if blocking {
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	tag := req.URL.Query().Get("tag")
+
+	var entries []map[string]interface{}
+	for _, entry := range s.entries {
+		if !entry.passing || (tag != "" && !containsString(entry.tags, tag)) {
+			continue
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"Node": map[string]interface{}{"Node": entry.node, "Address": "10.0.0.100"},
+			"Service": map[string]interface{}{
+				"ID": entry.id, "Service": "ringman", "Tags": entry.tags,
+				"Address": entry.address, "Port": entry.port,
+				"Meta": map[string]string{"version": "1.2.3"},
+			},
+		})
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *consulStub) query(i int) string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.queries[i]
+}
+
+func (s *consulStub) queryCount() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.queries)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func Test_ConsulRing(t *testing.T) {
+	Convey("ConsulRing", t, func() {
+		stub := newConsulStub(
+			consulStubEntry{node: "node-1", id: "ringman-1", address: "10.0.0.1", port: 8000, tags: []string{"prod"}, passing: true},
+			consulStubEntry{node: "node-2", id: "ringman-2", address: "10.0.0.2", port: 8000, tags: []string{"prod"}, passing: true},
+			consulStubEntry{node: "node-3", id: "ringman-3", address: "10.0.0.3", port: 8000, tags: []string{"prod"}, passing: false},
+			consulStubEntry{node: "node-4", id: "ringman-4", address: "10.0.0.4", port: 8000, tags: []string{"canary"}, passing: true},
+			consulStubEntry{node: "node-5", id: "ringman-5", address: "", port: 9000, tags: []string{"prod"}, passing: true},
+		)
+
+		Convey("adds the passing instances with the tag and port", func() {
+			ring, err := NewConsulRing(stub.server.URL, "ringman", "prod", 8000)
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			So(stub.query(0), ShouldContainSubstring, "passing=1")
+			So(stub.query(0), ShouldContainSubstring, "tag=prod")
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+			So(nodes[0].Name, ShouldEqual, "ringman-1")
+			So(nodes[0].Port, ShouldEqual, 8000)
+			So(nodes[0].Metadata["node"], ShouldEqual, "node-1")
+			So(nodes[0].Metadata["tags"], ShouldEqual, "prod")
+			So(nodes[0].Metadata["version"], ShouldEqual, "1.2.3")
+			So(nodes[1].ID, ShouldEqual, "10.0.0.2:8000")
+		})
+
+		Convey("uses the Consul node's address when the service has none", func() {
+			ring, err := NewConsulRing(stub.server.URL, "ringman", "", 9000)
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.100:9000")
+		})
+
+		Convey("follows changes with blocking queries", func() {
+			ring, err := NewConsulRing(stub.server.URL, "ringman", "prod", 8000)
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			stub.set(
+				consulStubEntry{node: "node-2", id: "ringman-2", address: "10.0.0.2", port: 8000, tags: []string{"prod"}, passing: false},
+				consulStubEntry{node: "node-3", id: "ringman-3", address: "10.0.0.3", port: 8000, tags: []string{"prod"}, passing: true},
+			)
+
+			nodes := waitForNodes(ring, 1)
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.3:8000")
+			So(stub.query(1), ShouldContainSubstring, "index=1")
+			So(stub.query(1), ShouldContainSubstring, "wait=300s")
+		})
+
+		Convey("blocks instead of spinning when Consul returns an index of 0", func() {
+			stub.Lock()
+			stub.index = 0
+			stub.Unlock()
+
+			ring, err := NewConsulRing(stub.server.URL, "ringman", "prod", 8000)
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			time.Sleep(50 * time.Millisecond)
+			So(stub.queryCount(), ShouldEqual, 2)
+			So(stub.query(1), ShouldContainSubstring, "index=1")
+			So(stub.query(1), ShouldContainSubstring, "wait=300s")
+		})
+
+		Convey("finds its local node from the hostname", func() {
+			hostname, _ := os.Hostname()
+			stub.set(
+				consulStubEntry{node: hostname, id: "ringman-1", address: "10.0.0.1", port: 8000, passing: true},
+				consulStubEntry{node: "node-2", id: "ringman-2", address: "10.0.0.2", port: 8000, passing: true},
+			)
+
+			ring, err := NewConsulRing(stub.server.URL, "ringman", "", 8000)
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			So(ring.LocalNode(), ShouldEqual, "10.0.0.1:8000")
+
+			owner, _ := ring.Manager().GetNode("bocaccio")
+			So(ring.IsLocal("bocaccio"), ShouldEqual, owner == "10.0.0.1:8000")
+		})
+
+		Convey("returns an error when Consul can't be queried", func() {
+			ring, err := NewConsulRing(stub.server.URL, "missing", "", 0)
+			So(err, ShouldNotBeNil)
+			So(ring, ShouldBeNil)
+		})
+
+		Convey("abandons a blocking query on Shutdown", func() {
+			ring, err := NewConsulRing(stub.server.URL, "ringman", "", 0)
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 200 && stub.queryCount() < 2; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			So(stub.queryCount(), ShouldEqual, 2)
+
+			ring.Shutdown()
+
+			// Close() waits for requests in flight, so would hang if the
+			// query were still blocking
+			stub.server.Close()
+
+			So(func() { ring.Shutdown() }, ShouldNotPanic)
+		})
+
+		Reset(func() {
+			stub.server.Close()
+		})
+	})
+}
@@ -3,13 +3,30 @@ package ringman
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"sync"
 
 	"github.com/Nitro/memberlist"
-	log "github.com/sirupsen/logrus"
 )
 
+const (
+	DefaultNodeWeight = 1
+)
+
+// NodeMetadata is gossiped to the other members of the cluster and describes
+// how this node should be placed in the ring. Weight is optional and nodes
+// that don't advertise one are given the DefaultNodeWeight. Zone and Rack are
+// optional too, and are used to spread replicas of a key across zones. A
+// node that is Draining stays in the ring but gives up the keys it owns.
+// Labels are passed along as the Metadata of the node's Node.
 type NodeMetadata struct {
 	ServicePort string
+	Weight      int               `json:",omitempty"`
+	Zone        string            `json:",omitempty"`
+	Rack        string            `json:",omitempty"`
+	Draining    bool              `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
 }
 
 // Delegate is a Memberlist delegate that is responsible for handling
@@ -19,6 +36,8 @@ type NodeMetadata struct {
 type Delegate struct {
 	RingMan      *HashRingManager
 	nodeMetadata *NodeMetadata
+	metaLock     sync.RWMutex
+	logger       loggerRef
 }
 
 func NewDelegate(ringMan *HashRingManager, meta *NodeMetadata) *Delegate {
@@ -30,73 +49,172 @@ func NewDelegate(ringMan *HashRingManager, meta *NodeMetadata) *Delegate {
 	return &delegate
 }
 
+// SetLogger sets the Logger the Delegate writes to. Until it is called, the
+// default Logger is used.
+func (d *Delegate) SetLogger(logger Logger) {
+	d.logger.set(logger)
+}
+
+// NodeMeta returns our NodeMetadata, encoded for gossip. Memberlist panics
+// if it is longer than limit, so if it won't fit, the Labels are left off,
+// and if it still won't fit, nothing is sent.
 func (d *Delegate) NodeMeta(limit int) []byte {
-	data, err := json.Marshal(d.nodeMetadata)
+	d.metaLock.RLock()
+	meta := *d.nodeMetadata
+	d.metaLock.RUnlock()
+
+	data, err := json.Marshal(&meta)
 	if err != nil {
-		log.Error("Error encoding Node metadata!")
+		d.logger.get().Error("Error encoding Node metadata!", "error", err)
 		data = []byte("{}")
 	}
-	log.Debugf("Setting metadata to: %s", string(data))
+
+	if len(data) > limit && len(meta.Labels) > 0 {
+		d.logger.get().Warn("Node metadata is too large, leaving off the Labels", "size", len(data), "limit", limit)
+		meta.Labels = nil
+		data, _ = json.Marshal(&meta)
+	}
+
+	if len(data) > limit {
+		d.logger.get().Error("Node metadata is too large, not sending it!", "size", len(data), "limit", limit)
+		return []byte{}
+	}
+
+	d.logger.get().Debug("Setting metadata", "meta", string(data))
 
 	return data
 }
 
 func (d *Delegate) NotifyMsg(message []byte) {
-	log.Debugf("NotifyMsg(): %s", string(message))
+	d.logger.get().Debug("NotifyMsg()", "message", string(message))
 }
 
 func (d *Delegate) GetBroadcasts(overhead, limit int) [][]byte {
-	//log.Debugf("GetBroadcasts(): %d %d", overhead, limit)
+	//d.logger.get().Debug("GetBroadcasts()", "overhead", overhead, "limit", limit)
 	return [][]byte{}
 }
 
 func (d *Delegate) LocalState(join bool) []byte {
-	log.Debugf("LocalState(): %t", join)
+	d.logger.get().Debug("LocalState()", "join", join)
 	return []byte{}
 }
 
 func (d *Delegate) MergeRemoteState(buf []byte, join bool) {
-	log.Debugf("MergeRemoteState(): %s %t", string(buf), join)
+	d.logger.get().Debug("MergeRemoteState()", "state", string(buf), "join", join)
 }
 
 func (d *Delegate) NotifyJoin(node *memberlist.Node) {
-	log.Debugf("NotifyJoin(): %s %s", node.Name, string(node.Meta))
+	d.logger.get().Debug("NotifyJoin()", "node", node.Name, "meta", string(node.Meta))
 
 	if d.RingMan == nil {
-		log.Warn("Ring manager was nil in delegate!")
+		d.logger.get().Warn("Ring manager was nil in delegate!")
 		return
 	}
 
-	nodeKey, err := d.keyForNode(node)
+	if metrics := d.RingMan.Metrics(); metrics != nil {
+		metrics.recordMemberEvent("join")
+	}
+
+	info, err := d.nodeForMember(node)
 	if err != nil {
-		log.Errorf("NotifyJoin: %s", err)
+		d.logger.get().Error("NotifyJoin()", "node", node.Name, "error", err)
 		return
 	}
 
-	d.RingMan.AddNode(nodeKey)
+	d.RingMan.AddNodeInfo(info)
+}
+
+// setDraining changes whether our own metadata says we are draining. It only
+// reaches the rest of the cluster once Memberlist gossips it. The change is
+// refused if it would make the metadata too large to gossip.
+func (d *Delegate) setDraining(draining bool) error {
+	d.metaLock.Lock()
+	defer d.metaLock.Unlock()
+
+	meta := *d.nodeMetadata
+	meta.Draining = draining
+
+	err := checkMetadataSize(&meta)
+	if err != nil {
+		return err
+	}
+
+	d.nodeMetadata.Draining = draining
+	return nil
+}
+
+// metadataForNode decodes the metadata the node advertised.
+func (d *Delegate) metadataForNode(node *memberlist.Node) (*NodeMetadata, error) {
+	meta, err := DecodeNodeMetadata(node.Meta)
+	if err != nil {
+		return nil, errors.New("Unable to decode metadata for " + node.Name + ", unable to add")
+	}
+
+	return meta, nil
 }
 
 // keyForNode takes a node and returns the key we use to store it in the
 // hashring. Currently based on the IP address and service port.
 func (d *Delegate) keyForNode(node *memberlist.Node) (string, error) {
-	meta, err := DecodeNodeMetadata(node.Meta)
+	meta, err := d.metadataForNode(node)
+	if err != nil {
+		return "", err
+	}
+
+	return keyForMetadata(node, meta), nil
+}
+
+// keyForMetadata is keyForNode for metadata that was already decoded.
+func keyForMetadata(node *memberlist.Node, meta *NodeMetadata) string {
+	return node.Addr.String() + ":" + meta.ServicePort
+}
+
+// nodeForMember returns the Node for a Memberlist node, decoding its
+// metadata only once. The weight is the DefaultNodeWeight if the node didn't
+// advertise a usable one, and the State says whether it is draining.
+func (d *Delegate) nodeForMember(node *memberlist.Node) (Node, error) {
+	meta, err := d.metadataForNode(node)
 	if err != nil {
-		return "", errors.New("Unable to decode metadata for " + node.Name + ", unable to add")
+		return Node{}, err
+	}
+
+	info := Node{
+		ID:       keyForMetadata(node, meta),
+		Name:     node.Name,
+		Address:  node.Addr.String(),
+		Weight:   meta.Weight,
+		Location: Location{Zone: meta.Zone, Rack: meta.Rack},
+		Metadata: meta.Labels,
+		State:    NodeStateAlive,
+	}
+
+	if info.Weight < 1 {
+		info.Weight = DefaultNodeWeight
 	}
 
-	return node.Addr.String() + ":" + meta.ServicePort, nil
+	if meta.Draining {
+		info.State = NodeStateDraining
+	}
+
+	info.Port, _ = strconv.Atoi(meta.ServicePort)
+
+	return info, nil
 }
 
 func (d *Delegate) NotifyLeave(node *memberlist.Node) {
-	log.Debugf("NotifyLeave(): %s", node.Name)
+	d.logger.get().Debug("NotifyLeave()", "node", node.Name)
 	if d.RingMan == nil {
-		log.Error("Ring manager was nil in delegate!")
+		d.logger.get().Error("Ring manager was nil in delegate!")
 		return
 	}
 
+	if metrics := d.RingMan.Metrics(); metrics != nil {
+		metrics.recordMemberEvent("leave")
+	}
+
 	nodeKey, err := d.keyForNode(node)
 	if err != nil {
-		log.Errorf("NotifyLeave: %s", err)
+		d.logger.get().Error("NotifyLeave()", "node", node.Name, "error", err)
 		return
 	}
 
@@ -104,7 +222,41 @@ func (d *Delegate) NotifyLeave(node *memberlist.Node) {
 }
 
 func (d *Delegate) NotifyUpdate(node *memberlist.Node) {
-	log.Debugf("NotifyUpdate(): %s - %s", node.Name, node.Meta)
+	d.logger.get().Debug("NotifyUpdate()", "node", node.Name, "meta", string(node.Meta))
+	if d.RingMan == nil {
+		d.logger.get().Error("Ring manager was nil in delegate!")
+		return
+	}
+
+	if metrics := d.RingMan.Metrics(); metrics != nil {
+		metrics.recordMemberEvent("update")
+	}
+
+	info, err := d.nodeForMember(node)
+	if err != nil {
+		d.logger.get().Error("NotifyUpdate()", "node", node.Name, "error", err)
+		return
+	}
+
+	// The metadata may carry a new weight or location, or tell us the node
+	// is draining. Adding a node that is already in the ring updates them.
+	d.RingMan.AddNodeInfo(info)
+}
+
+// checkMetadataSize returns an error if the NodeMetadata is too large for
+// Memberlist to gossip.
+func checkMetadataSize(meta *NodeMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("Unable to encode NodeMetadata: %s", err)
+	}
+
+	if len(data) > memberlist.MetaMaxSize {
+		return fmt.Errorf("NodeMetadata is %d bytes, more than the %d Memberlist allows!",
+			len(data), memberlist.MetaMaxSize)
+	}
+
+	return nil
 }
 
 // DecodeNodeMetadata takes a byte slice and deserializes it
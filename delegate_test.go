@@ -0,0 +1,134 @@
+package ringman
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Nitro/memberlist"
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Delegate(t *testing.T) {
+	Convey("Delegate", t, func() {
+		ringMgr := NewHashRingManager([]string{})
+		delegate := NewDelegate(ringMgr, &NodeMetadata{ServicePort: "8000"})
+
+		node := &memberlist.Node{
+			Name: "njal",
+			Addr: net.ParseIP("10.0.0.1"),
+			Meta: []byte(`{"ServicePort": "8000", "Weight": 5}`),
+		}
+
+		Convey("nodeForMember()", func() {
+			Convey("returns the weight from the metadata", func() {
+				info, err := delegate.nodeForMember(node)
+				So(err, ShouldBeNil)
+				So(info.Weight, ShouldEqual, 5)
+			})
+
+			Convey("returns the default weight when none is advertised", func() {
+				node.Meta = []byte(`{"ServicePort": "8000"}`)
+				info, err := delegate.nodeForMember(node)
+				So(err, ShouldBeNil)
+				So(info.Weight, ShouldEqual, DefaultNodeWeight)
+			})
+
+			Convey("returns the draining state from the metadata", func() {
+				node.Meta = []byte(`{"ServicePort": "8000", "Draining": true}`)
+				info, err := delegate.nodeForMember(node)
+				So(err, ShouldBeNil)
+				So(info.State, ShouldEqual, NodeStateDraining)
+			})
+
+			Convey("returns an error on bad metadata", func() {
+				node.Meta = []byte(`junk`)
+				_, err := delegate.nodeForMember(node)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("NotifyJoin() and NotifyUpdate() add the node to the ring", func() {
+			go ringMgr.Run(director.NewFreeLooper(8, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			delegate.NotifyJoin(node)
+			node.Meta = []byte(`{"ServicePort": "8000", "Weight": 2}`)
+			delegate.NotifyUpdate(node)
+
+			owner, err := ringMgr.GetNode("beowulf")
+			So(err, ShouldBeNil)
+			So(owner, ShouldEqual, "10.0.0.1:8000")
+		})
+
+		Convey("NotifyJoin() keeps the Node for the member", func() {
+			go ringMgr.Run(director.NewFreeLooper(8, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			node.Meta = []byte(`{"ServicePort": "8000", "Zone": "us-east-1a", "Labels": {"version": "1.2.3"}}`)
+			delegate.NotifyJoin(node)
+
+			info, err := ringMgr.GetNodeInfo("beowulf")
+			So(err, ShouldBeNil)
+			So(info.ID, ShouldEqual, "10.0.0.1:8000")
+			So(info.Name, ShouldEqual, node.Name)
+			So(info.Address, ShouldEqual, "10.0.0.1")
+			So(info.Port, ShouldEqual, 8000)
+			So(info.Location.Zone, ShouldEqual, "us-east-1a")
+			So(info.Metadata["version"], ShouldEqual, "1.2.3")
+			So(info.State, ShouldEqual, NodeStateAlive)
+		})
+
+		Convey("NodeMeta() encodes the weight", func() {
+			delegate.nodeMetadata.Weight = 3
+			So(string(delegate.NodeMeta(512)), ShouldContainSubstring, `"Weight":3`)
+		})
+
+		Convey("NodeMeta() encodes the zone and rack", func() {
+			delegate.nodeMetadata.Zone = "us-east-1a"
+			delegate.nodeMetadata.Rack = "r12"
+
+			meta, err := DecodeNodeMetadata(delegate.NodeMeta(512))
+			So(err, ShouldBeNil)
+			So(meta.Zone, ShouldEqual, "us-east-1a")
+			So(meta.Rack, ShouldEqual, "r12")
+		})
+
+		Convey("NodeMeta() never returns more than the limit", func() {
+			delegate.nodeMetadata.Labels = map[string]string{"notes": strings.Repeat("x", 600)}
+
+			meta, err := DecodeNodeMetadata(delegate.NodeMeta(512))
+			So(err, ShouldBeNil)
+			So(meta.ServicePort, ShouldEqual, "8000")
+			So(meta.Labels, ShouldBeEmpty)
+
+			So(delegate.NodeMeta(5), ShouldBeEmpty)
+		})
+
+		Convey("won't drain if the metadata would be too large", func() {
+			delegate.nodeMetadata.Labels = map[string]string{"notes": strings.Repeat("x", 460)}
+			So(checkMetadataSize(delegate.nodeMetadata), ShouldBeNil)
+
+			So(delegate.setDraining(true), ShouldNotBeNil)
+			So(delegate.nodeMetadata.Draining, ShouldBeFalse)
+		})
+
+		Convey("NotifyJoin() and NotifyUpdate() record the location", func() {
+			go ringMgr.Run(director.NewFreeLooper(8, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			node.Meta = []byte(`{"ServicePort": "8000", "Zone": "us-east-1a", "Rack": "r12"}`)
+			delegate.NotifyJoin(node)
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Location("10.0.0.1:8000"), ShouldResemble, Location{Zone: "us-east-1a", Rack: "r12"})
+
+			node.Meta = []byte(`{"ServicePort": "8000", "Zone": "us-east-1b"}`)
+			delegate.NotifyUpdate(node)
+
+			snap, _ = ringMgr.Snapshot()
+			So(snap.Location("10.0.0.1:8000"), ShouldResemble, Location{Zone: "us-east-1b"})
+		})
+	})
+}
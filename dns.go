@@ -0,0 +1,174 @@
+package ringman
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/relistan/go-director"
+)
+
+const (
+	DefaultDNSRefreshInterval = 10 * time.Second // How often a DNSRing resolves its name
+	DNSLookupTimeout          = 5 * time.Second  // How long we wait for each resolution
+)
+
+// A Resolver looks up the records a DNSRing is built from. *net.Resolver is
+// one, and is what is used by default.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// A DNSRing is a ring whose members are discovered from DNS. It resolves a
+// SRV name, or an A/AAAA name for nodes that all listen on the same port, and
+// refreshes the ring from it periodically. If a resolution fails, or finds no
+// records, the error is logged and the ring is left as it was.
+type DNSRing struct {
+	managedRing
+	refreshLooper director.Looper
+	name          string
+	port          int // If 0, name is a SRV name
+	resolver      Resolver
+}
+
+// Ensure DNSRing implements Ring interface
+var _ Ring = (*DNSRing)(nil)
+
+// NewDNSRing returns a running DNSRing that is refreshed every
+// DefaultDNSRefreshInterval using the system resolver. If port is 0, name
+// is looked up as a SRV record, e.g. "_http._tcp.myservice.example.com", and
+// each target and port is a node. Otherwise it is looked up as an A/AAAA
+// record, and each address with the port is a node.
+func NewDNSRing(name string, port int) (*DNSRing, error) {
+	return NewDNSRingWithResolver(name, port, DefaultDNSRefreshInterval, net.DefaultResolver)
+}
+
+// NewDNSRingWithResolver returns a DNSRing configured like NewDNSRing does,
+// but refreshed every interval using the Resolver provided.
+func NewDNSRingWithResolver(name string, port int, interval time.Duration,
+	resolver Resolver) (*DNSRing, error) {
+
+	if interval <= 0 {
+		interval = DefaultDNSRefreshInterval
+	}
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	dnsRing := &DNSRing{
+		name:     name,
+		port:     port,
+		resolver: resolver,
+	}
+	dnsRing.startManager()
+
+	// Bootstrap, so the ring is ready to use when we return it
+	err := dnsRing.refresh()
+	if err != nil {
+		dnsRing.Shutdown()
+		return nil, err
+	}
+
+	dnsRing.refreshLooper = director.NewTimedLooper(director.FOREVER, interval, nil)
+	go dnsRing.refreshLooper.Loop(func() error {
+		if err := dnsRing.refresh(); err != nil {
+			dnsRing.logger.get().Error("Unable to refresh ring from DNS", "name", name, "error", err)
+		}
+		return nil
+	})
+
+	return dnsRing, nil
+}
+
+// refresh resolves the name and replaces the membership of the ring with what
+// it found. Only one refresh must run at once.
+func (r *DNSRing) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DNSLookupTimeout)
+	defer cancel()
+
+	infos, err := r.resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Every node going away at once is more likely a problem with DNS, so
+	// like a StaticRing, we never empty the ring
+	if len(infos) == 0 {
+		return fmt.Errorf("No nodes found for %s", r.name)
+	}
+
+	// Replace the whole set at once, so the ring is only rebuilt once. Nodes
+	// that haven't changed are left alone, and if none have, the version
+	// stays the same.
+	err = r.manager.SetNodesInfo(infos)
+	if err != nil {
+		return fmt.Errorf("Unable to update ring: %s", err)
+	}
+
+	return nil
+}
+
+// resolve looks up the name and returns a Node for each record.
+func (r *DNSRing) resolve(ctx context.Context) ([]Node, error) {
+	if r.port == 0 {
+		return r.resolveSRV(ctx)
+	}
+
+	addrs, err := r.resolver.LookupHost(ctx, r.name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve %s: %s", r.name, err)
+	}
+
+	infos := make([]Node, 0, len(addrs))
+	for _, addr := range addrs {
+		info := nodeFromID(net.JoinHostPort(addr, strconv.Itoa(r.port)))
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// resolveSRV looks up the SRV name and returns a Node for each target. The
+// priority and weight of each record are kept in the Node's Metadata.
+func (r *DNSRing) resolveSRV(ctx context.Context) ([]Node, error) {
+	_, records, err := r.resolver.LookupSRV(ctx, "", "", r.name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve SRV %s: %s", r.name, err)
+	}
+
+	infos := make([]Node, 0, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+
+		info := nodeFromID(net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+		info.Name = target
+		info.Metadata = map[string]string{
+			"priority": strconv.Itoa(int(record.Priority)),
+			"weight":   strconv.Itoa(int(record.Weight)),
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// SetLocalNode tells the ring which of its nodes this one is.
+func (r *DNSRing) SetLocalNode(id string) {
+	r.setLocalNode(id)
+}
+
+// Shutdown stops refreshing from DNS and stops the HashRingManager
+func (r *DNSRing) Shutdown() {
+	r.shutdown(func() {
+		if r.refreshLooper != nil {
+			r.refreshLooper.Quit()
+		}
+
+		r.stopManager()
+	})
+}
@@ -0,0 +1,227 @@
+package ringman
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// dnsStub is an in-process DNS server that answers with whatever records
+// it has been given
+type dnsStub struct {
+	sync.Mutex
+	server  *dns.Server
+	records map[uint16][]dns.RR
+}
+
+func newDNSStub() *dnsStub {
+	stub := &dnsStub{records: make(map[uint16][]dns.RR)}
+
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	stub.server = &dns.Server{PacketConn: conn, Handler: stub}
+
+	started := make(chan struct{})
+	stub.server.NotifyStartedFunc = func() { close(started) }
+	go stub.server.ActivateAndServe()
+	<-started
+
+	return stub
+}
+
+func (s *dnsStub) set(qtype uint16, records ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.records[qtype] = nil
+	for _, record := range records {
+		rr, _ := dns.NewRR(record)
+		s.records[qtype] = append(s.records[qtype], rr)
+	}
+}
+
+func (s *dnsStub) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, rr := range s.records[req.Question[0].Qtype] {
+		if rr.Header().Name == req.Question[0].Name {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+
+	w.WriteMsg(resp)
+}
+
+// resolver returns a Go resolver that only talks to the stub
+func (s *dnsStub) resolver() *net.Resolver {
+	addr := s.server.PacketConn.LocalAddr().String()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+// emptyResolver answers every lookup without error, but with no records
+type emptyResolver struct{}
+
+func (emptyResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, nil, nil
+}
+
+func (emptyResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, nil
+}
+
+func Test_DNSRing(t *testing.T) {
+	Convey("DNSRing", t, func() {
+		stub := newDNSStub()
+
+		stub.set(dns.TypeSRV,
+			"_http._tcp.ringman.test. 60 IN SRV 10 5 8000 node1.ringman.test.",
+			"_http._tcp.ringman.test. 60 IN SRV 10 5 8001 node2.ringman.test.",
+		)
+		stub.set(dns.TypeA,
+			"ringman.test. 60 IN A 10.0.0.1",
+			"ringman.test. 60 IN A 10.0.0.2",
+		)
+
+		Convey("builds the ring from SRV records", func() {
+			ring, err := NewDNSRingWithResolver("_http._tcp.ringman.test.", 0, time.Hour, stub.resolver())
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, "node1.ringman.test:8000")
+			So(nodes[0].Address, ShouldEqual, "node1.ringman.test")
+			So(nodes[0].Port, ShouldEqual, 8000)
+			So(nodes[0].Metadata["priority"], ShouldEqual, "10")
+			So(nodes[1].ID, ShouldEqual, "node2.ringman.test:8001")
+		})
+
+		Convey("builds the ring from A records and a port", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, time.Hour, stub.resolver())
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:9000")
+			So(nodes[1].ID, ShouldEqual, "10.0.0.2:9000")
+		})
+
+		Convey("applies changes to the records", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, time.Hour, stub.resolver())
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			stub.set(dns.TypeA,
+				"ringman.test. 60 IN A 10.0.0.2",
+				"ringman.test. 60 IN A 10.0.0.3",
+			)
+			So(ring.refresh(), ShouldBeNil)
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.2:9000")
+			So(nodes[1].ID, ShouldEqual, "10.0.0.3:9000")
+
+			// All at once, and nothing when nothing changed
+			So(ring.Manager().Version(), ShouldEqual, 2)
+			So(ring.refresh(), ShouldBeNil)
+			So(ring.Manager().Version(), ShouldEqual, 2)
+		})
+
+		Convey("refreshes periodically", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, 10*time.Millisecond, stub.resolver())
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			stub.set(dns.TypeA, "ringman.test. 60 IN A 10.0.0.9")
+
+			var nodes []Node
+			for i := 0; i < 200; i++ {
+				nodes, _ = ring.Manager().ListNodes()
+				if len(nodes) == 1 {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.9:9000")
+		})
+
+		Convey("keeps the ring as it was when resolution fails", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, time.Hour, stub.resolver())
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			stub.set(dns.TypeA)
+			So(ring.refresh(), ShouldNotBeNil)
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+		})
+
+		Convey("keeps the ring as it was when no records are found", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, time.Hour, stub.resolver())
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			ring.resolver = emptyResolver{}
+			So(ring.refresh(), ShouldNotBeNil)
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+
+			ring.port = 0
+			So(ring.refresh(), ShouldNotBeNil)
+			So(ring.Manager().Version(), ShouldEqual, 1)
+		})
+
+		Convey("returns an error when no records are found", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, time.Hour, emptyResolver{})
+			So(err, ShouldNotBeNil)
+			So(ring, ShouldBeNil)
+		})
+
+		Convey("returns an error when the name can't be resolved", func() {
+			ring, err := NewDNSRingWithResolver("missing.ringman.test.", 0, time.Hour, stub.resolver())
+			So(err, ShouldNotBeNil)
+			So(ring, ShouldBeNil)
+		})
+
+		Convey("can be shut down more than once", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, time.Millisecond, stub.resolver())
+			So(err, ShouldBeNil)
+
+			ring.Shutdown()
+			So(func() { ring.Shutdown() }, ShouldNotPanic)
+		})
+
+		Convey("knows its local node once told", func() {
+			ring, err := NewDNSRingWithResolver("ringman.test.", 9000, time.Hour, stub.resolver())
+			So(err, ShouldBeNil)
+			defer ring.Shutdown()
+
+			owner, _ := ring.Manager().GetNode("bocaccio")
+			ring.SetLocalNode(owner)
+			So(ring.IsLocal("bocaccio"), ShouldBeTrue)
+		})
+
+		Reset(func() {
+			stub.server.Shutdown()
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package ringman
+
+import (
+	"context"
+	"sort"
+)
+
+// SetDraining is a blocking call that marks a node in the ring as draining,
+// or not, and waits for it to be applied. A draining node stays in the ring
+// but owns no keys: each key it owned moves to the node that would own it if
+// the draining node were gone. Lookups can still find the draining node with
+// GetHandoffNode, so the new owner can pick up where it left off. Draining a
+// node that is not in the ring does nothing.
+func (r *HashRingManager) SetDraining(nodeName string, draining bool) error {
+	return r.SetDrainingContext(context.Background(), nodeName, draining)
+}
+
+// SetDrainingContext is like SetDraining but gives up when the context is
+// done.
+func (r *HashRingManager) SetDrainingContext(ctx context.Context, nodeName string, draining bool) error {
+	return r.sendChange(ctx, RingCommand{Command: CmdSetDraining, NodeName: nodeName, Draining: draining})
+}
+
+// GetHandoffNode returns the draining node that owned the key before it began
+// draining, or an empty string if the key's owner isn't draining.
+func (r *HashRingManager) GetHandoffNode(key string) (string, error) {
+	snap, err := r.Snapshot()
+	if err != nil {
+		return "", err
+	}
+
+	node, _ := snap.HandoffNode(key)
+	return node, nil
+}
+
+// GetHandoffNodeContext is like GetHandoffNode but returns the context's
+// error if it is already done.
+func (r *HashRingManager) GetHandoffNodeContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return r.GetHandoffNode(key)
+}
+
+// IsDraining returns true if the node was draining as of this version of the
+// ring.
+func (s *RingSnapshot) IsDraining(node string) bool {
+	return s.draining[node]
+}
+
+// Draining returns the nodes that were draining as of this version of the
+// ring, sorted by name.
+func (s *RingSnapshot) Draining() []string {
+	nodes := make([]string, 0, len(s.draining))
+	for node := range s.draining {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// HandoffNode returns the draining node that owned the key before it began
+// draining. It returns false if the key's owner isn't draining.
+func (s *RingSnapshot) HandoffNode(key string) (string, bool) {
+	if s.handoff == nil {
+		return "", false
+	}
+
+	node, ok := s.handoff.GetNode(key)
+	if !ok || !s.draining[node] {
+		return "", false
+	}
+
+	return node, true
+}
@@ -0,0 +1,152 @@
+package ringman
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/Nitro/memberlist"
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Draining(t *testing.T) {
+	Convey("Draining a node", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal", "kjartan", "gunnar"})
+		go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+		So(ringMgr.Ping(), ShouldBeTrue)
+
+		keys := placementKeys(200)
+		owners := make(map[string]string, len(keys))
+		for _, key := range keys {
+			owners[key], _ = ringMgr.GetNode(key)
+		}
+
+		events := make(chan RingEvent, 10)
+		ringMgr.Subscribe(events)
+
+		So(ringMgr.SetDraining("njal", true), ShouldBeNil)
+
+		Convey("moves its keys to the other nodes", func() {
+			without := NewHashringPlacement(map[string]int{"kjartan": 1, "gunnar": 1})
+
+			for _, key := range keys {
+				node, err := ringMgr.GetNode(key)
+				So(err, ShouldBeNil)
+				So(node, ShouldNotEqual, "njal")
+
+				expected, _ := without.GetNode(key)
+				So(node, ShouldEqual, expected)
+			}
+		})
+
+		Convey("lets lookups find it for handoff", func() {
+			for _, key := range keys {
+				handoff, err := ringMgr.GetHandoffNode(key)
+				So(err, ShouldBeNil)
+
+				if owners[key] == "njal" {
+					So(handoff, ShouldEqual, "njal")
+				} else {
+					So(handoff, ShouldEqual, "")
+				}
+			}
+		})
+
+		Convey("is reported in the snapshot and to subscribers", func() {
+			snap, _ := ringMgr.Snapshot()
+			So(snap.IsDraining("njal"), ShouldBeTrue)
+			So(snap.Draining(), ShouldResemble, []string{"njal"})
+			So(snap.Size(), ShouldEqual, 2)
+
+			evt := <-events
+			So(evt.Type, ShouldEqual, NodeDraining)
+			So(evt.Node, ShouldEqual, "njal")
+		})
+
+		Convey("can be undone", func() {
+			So(ringMgr.SetDraining("njal", false), ShouldBeNil)
+			<-events
+			So((<-events).Type, ShouldEqual, NodeResumed)
+
+			for _, key := range keys {
+				node, _ := ringMgr.GetNode(key)
+				So(node, ShouldEqual, owners[key])
+			}
+
+			handoff, _ := ringMgr.GetHandoffNode(keys[0])
+			So(handoff, ShouldEqual, "")
+		})
+
+		Convey("is forgotten when the node is removed", func() {
+			ringMgr.RemoveNode("njal")
+			ringMgr.AddNode("njal")
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.IsDraining("njal"), ShouldBeFalse)
+		})
+
+		Convey("does nothing for unknown nodes", func() {
+			before, _ := ringMgr.Snapshot()
+			ringMgr.SetDraining("hallgerd", true)
+
+			after, _ := ringMgr.Snapshot()
+			So(after.Version, ShouldEqual, before.Version)
+		})
+
+		Convey("leaves keys in place when every node drains", func() {
+			ringMgr.SetDraining("kjartan", true)
+			ringMgr.SetDraining("gunnar", true)
+
+			for _, key := range keys {
+				node, err := ringMgr.GetNode(key)
+				So(err, ShouldBeNil)
+				So(node, ShouldEqual, owners[key])
+			}
+		})
+
+		Reset(func() { ringMgr.Stop() })
+	})
+
+	Convey("The delegate drains nodes from their metadata", t, func() {
+		ringMgr := NewHashRingManager([]string{})
+		go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+		So(ringMgr.Ping(), ShouldBeTrue)
+
+		delegate := NewDelegate(ringMgr, &NodeMetadata{ServicePort: "8000"})
+		for i := 1; i <= 3; i++ {
+			delegate.NotifyJoin(testNode(i, false))
+		}
+
+		So(ringMgr.Version(), ShouldEqual, 3)
+
+		// Each change of state is a single new version of the ring
+		delegate.NotifyUpdate(testNode(1, true))
+		snap, _ := ringMgr.Snapshot()
+		So(snap.IsDraining("10.0.0.1:8000"), ShouldBeTrue)
+		So(snap.Version, ShouldEqual, 4)
+
+		delegate.NotifyUpdate(testNode(1, false))
+		snap, _ = ringMgr.Snapshot()
+		So(snap.IsDraining("10.0.0.1:8000"), ShouldBeFalse)
+		So(snap.Version, ShouldEqual, 5)
+
+		delegate.NotifyJoin(testNode(4, true))
+		snap, _ = ringMgr.Snapshot()
+		So(snap.IsDraining("10.0.0.4:8000"), ShouldBeTrue)
+		So(snap.Version, ShouldEqual, 6)
+
+		delegate.setDraining(true)
+		So(string(delegate.NodeMeta(512)), ShouldContainSubstring, `"Draining":true`)
+
+		ringMgr.Stop()
+	})
+}
+
+func testNode(i int, draining bool) *memberlist.Node {
+	return &memberlist.Node{
+		Name: fmt.Sprintf("node-%d", i),
+		Addr: net.ParseIP(fmt.Sprintf("10.0.0.%d", i)),
+		Meta: []byte(fmt.Sprintf(`{"ServicePort": "8000", "Draining": %t}`, draining)),
+	}
+}
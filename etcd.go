@@ -0,0 +1,394 @@
+package ringman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	DefaultEtcdPrefix   = "/ringman/nodes/"
+	DefaultEtcdLeaseTTL = 10              // Seconds our registration outlives us if we die
+	EtcdRequestTimeout  = 5 * time.Second // How long we wait for each request to etcd
+	EtcdRetryInterval   = 1 * time.Second // How long we wait after a failed registration or watch
+)
+
+// An EtcdRing is a ring whose members register themselves in etcd, for
+// clusters where gossip isn't possible. Each node puts its NodeMetadata
+// under a key in the prefix, on a lease that it keeps alive, and watches the
+// prefix to keep the ring in step. A node that dies drops out of the ring
+// when its lease expires.
+type EtcdRing struct {
+	managedRing
+	client  *clientv3.Client
+	prefix  string
+	ttl     int64
+	nodeKey string // Our own key in the ring
+	meta    *NodeMetadata
+	leaseID clientv3.LeaseID
+	lock    sync.Mutex // Protects meta and leaseID
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed when the watch has stopped
+}
+
+// Ensure EtcdRing implements Ring interface
+var _ Ring = (*EtcdRing)(nil)
+
+// NewEtcdRing returns a running EtcdRing that registers this node in etcd
+// under DefaultEtcdPrefix. Like a MemberlistRing, the node is stored in the
+// ring under its address and meta.ServicePort, and can be given a Weight,
+// Zone, Rack and Labels in the NodeMetadata. The client is not closed by
+// Shutdown.
+func NewEtcdRing(client *clientv3.Client, address string, meta *NodeMetadata) (*EtcdRing, error) {
+	return NewEtcdRingWithPrefix(client, DefaultEtcdPrefix, DefaultEtcdLeaseTTL, address, meta)
+}
+
+// NewEtcdRingWithPrefix returns an EtcdRing configured like NewEtcdRing does,
+// but registered under the prefix provided, on a lease of ttl seconds. Every
+// node in the cluster must use the same prefix.
+func NewEtcdRingWithPrefix(client *clientv3.Client, prefix string, ttl int64, address string,
+	meta *NodeMetadata) (*EtcdRing, error) {
+
+	if meta == nil {
+		return nil, fmt.Errorf("NodeMetadata must not be nil")
+	}
+
+	if ttl < 1 {
+		ttl = DefaultEtcdLeaseTTL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Keep our own copy, so the caller can't change it underneath us
+	ourMeta := *meta
+	ourMeta.Labels = copyMetadata(meta.Labels)
+
+	etcdRing := &EtcdRing{
+		client:  client,
+		prefix:  prefix,
+		ttl:     ttl,
+		nodeKey: net.JoinHostPort(address, meta.ServicePort),
+		meta:    &ourMeta,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	etcdRing.setLocalNode(etcdRing.nodeKey)
+	etcdRing.startManager()
+
+	// Register, and load the ring, before we return it
+	keepAlive, err := etcdRing.register(ctx)
+	if err != nil {
+		cancel()
+		etcdRing.stop()
+		return nil, err
+	}
+
+	rev, err := etcdRing.sync(ctx)
+	if err != nil {
+		cancel()
+		etcdRing.stop()
+		return nil, err
+	}
+
+	go etcdRing.run(ctx, keepAlive, rev)
+
+	return etcdRing, nil
+}
+
+// register puts our NodeMetadata under our key on a new lease, and keeps the
+// lease alive until the context is done.
+func (r *EtcdRing) register(ctx context.Context) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, EtcdRequestTimeout)
+	defer cancel()
+
+	lease, err := r.client.Grant(reqCtx, r.ttl)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get a lease from etcd: %s", err)
+	}
+
+	r.lock.Lock()
+	r.leaseID = lease.ID
+	r.lock.Unlock()
+
+	err = r.put(reqCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive, err := r.client.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to keep our etcd lease alive: %s", err)
+	}
+
+	return keepAlive, nil
+}
+
+// put writes our NodeMetadata under our key, on our current lease.
+func (r *EtcdRing) put(ctx context.Context) error {
+	r.lock.Lock()
+	meta := *r.meta
+	r.lock.Unlock()
+
+	return r.putMetadata(ctx, &meta)
+}
+
+// putMetadata writes the NodeMetadata under our key, on our current lease,
+// without making it our own.
+func (r *EtcdRing) putMetadata(ctx context.Context, meta *NodeMetadata) error {
+	r.lock.Lock()
+	leaseID := r.leaseID
+	r.lock.Unlock()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("Unable to encode NodeMetadata: %s", err)
+	}
+
+	_, err = r.client.Put(ctx, r.prefix+r.nodeKey, string(data), clientv3.WithLease(leaseID))
+	if err != nil {
+		return fmt.Errorf("Unable to register in etcd: %s", err)
+	}
+
+	return nil
+}
+
+// sync replaces the membership of the ring with the nodes registered under
+// the prefix, and returns the etcd revision they were read at.
+func (r *EtcdRing) sync(ctx context.Context) (int64, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, EtcdRequestTimeout)
+	defer cancel()
+
+	resp, err := r.client.Get(reqCtx, r.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, fmt.Errorf("Unable to list nodes in etcd: %s", err)
+	}
+
+	infos := make([]Node, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		info, err := r.nodeForKey(string(kv.Key), kv.Value)
+		if err != nil {
+			r.logger.get().Error("Unable to add node to the ring", "key", string(kv.Key), "error", err)
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	// Replace the whole set at once, so the ring is only rebuilt once
+	err = r.manager.SetNodesInfo(infos)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to update ring: %s", err)
+	}
+
+	return resp.Header.Revision, nil
+}
+
+// run watches the prefix from just after rev and applies each change to the
+// ring, until the context is done. If our lease is lost, we register again,
+// and if the watch fails, we sync from scratch and start it again.
+func (r *EtcdRing) run(ctx context.Context, keepAlive <-chan *clientv3.LeaseKeepAliveResponse, rev int64) {
+	defer close(r.done)
+
+	watchChan := r.client.Watch(ctx, r.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case _, ok := <-keepAlive:
+			if ok {
+				continue
+			}
+
+			keepAlive = r.reregister(ctx)
+
+		case resp, ok := <-watchChan:
+			if ok && resp.Err() == nil {
+				r.applyEvents(resp.Events)
+				continue
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if ok {
+				r.logger.get().Error("Lost our watch on etcd", "prefix", r.prefix, "error", resp.Err())
+			}
+
+			watchChan = r.rewatch(ctx)
+		}
+	}
+}
+
+// reregister registers us again once our lease has been lost, retrying
+// until it succeeds or the context is done.
+func (r *EtcdRing) reregister(ctx context.Context) <-chan *clientv3.LeaseKeepAliveResponse {
+	r.logger.get().Warn("Lost our etcd lease, registering again", "node", r.nodeKey)
+
+	for {
+		keepAlive, err := r.register(ctx)
+		if err == nil {
+			return keepAlive
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		r.logger.get().Error("Unable to register in etcd", "node", r.nodeKey, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(EtcdRetryInterval):
+		}
+	}
+}
+
+// rewatch syncs the ring from scratch and starts a new watch from there,
+// retrying until it succeeds or the context is done.
+func (r *EtcdRing) rewatch(ctx context.Context) clientv3.WatchChan {
+	for {
+		rev, err := r.sync(ctx)
+		if err == nil {
+			return r.client.Watch(ctx, r.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		r.logger.get().Error("Unable to sync ring from etcd", "prefix", r.prefix, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(EtcdRetryInterval):
+		}
+	}
+}
+
+// applyEvents applies the changes under the prefix to the ring, all at once.
+func (r *EtcdRing) applyEvents(events []*clientv3.Event) {
+	added := make(map[string]Node, len(events))
+	var removed []string
+
+	for _, event := range events {
+		key := string(event.Kv.Key)
+
+		// Removals are applied first, so a node that comes back in the
+		// same batch is kept
+		if event.Type == clientv3.EventTypeDelete {
+			id := strings.TrimPrefix(key, r.prefix)
+			delete(added, id)
+			removed = append(removed, id)
+			continue
+		}
+
+		info, err := r.nodeForKey(key, event.Kv.Value)
+		if err != nil {
+			r.logger.get().Error("Unable to add node to the ring", "key", key, "error", err)
+			continue
+		}
+
+		added[info.ID] = info
+	}
+
+	nodes := make([]Node, 0, len(added))
+	for _, info := range added {
+		nodes = append(nodes, info)
+	}
+
+	err := r.manager.ApplyDiffInfo(nodes, removed)
+	if err != nil {
+		r.logger.get().Error("Unable to update ring", "error", err)
+	}
+}
+
+// nodeForKey returns the Node for a key under the prefix, from the
+// NodeMetadata stored under it. The node's ID is the rest of the key.
+func (r *EtcdRing) nodeForKey(key string, value []byte) (Node, error) {
+	meta, err := DecodeNodeMetadata(value)
+	if err != nil {
+		return Node{}, fmt.Errorf("Unable to decode metadata: %s", err)
+	}
+
+	info := nodeFromID(strings.TrimPrefix(key, r.prefix))
+	info.Weight = meta.Weight
+	if info.Weight < 1 {
+		// Otherwise a node that registers again without one keeps its old weight
+		info.Weight = DefaultNodeWeight
+	}
+	info.Location = Location{Zone: meta.Zone, Rack: meta.Rack}
+	info.Metadata = meta.Labels
+
+	info.State = NodeStateAlive
+	if meta.Draining {
+		info.State = NodeStateDraining
+	}
+
+	return info, nil
+}
+
+// Drain marks this node as draining in etcd, so every node hands off its keys
+// the same way as with a MemberlistRing.
+func (r *EtcdRing) Drain() error {
+	r.lock.Lock()
+	meta := *r.meta
+	r.lock.Unlock()
+	meta.Draining = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), EtcdRequestTimeout)
+	defer cancel()
+
+	// Only keep the new metadata once etcd has it, or we'd register as
+	// draining again later without having told anyone
+	err := r.putMetadata(ctx, &meta)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.meta.Draining = true
+	r.lock.Unlock()
+
+	// Don't wait on the watch to tell us about ourselves
+	return r.manager.SetDraining(r.nodeKey, true)
+}
+
+// Shutdown stops watching etcd, revokes our lease so the other nodes drop us
+// from the ring straight away, and stops the HashRingManager.
+func (r *EtcdRing) Shutdown() {
+	r.shutdown(func() {
+		r.cancel()
+		<-r.done
+
+		r.stop()
+	})
+}
+
+// stop revokes our lease, if we have one, and stops the HashRingManager.
+func (r *EtcdRing) stop() {
+	r.lock.Lock()
+	leaseID := r.leaseID
+	r.lock.Unlock()
+
+	if leaseID != clientv3.NoLease {
+		ctx, cancel := context.WithTimeout(context.Background(), EtcdRequestTimeout)
+		_, err := r.client.Revoke(ctx, leaseID)
+		cancel()
+		if err != nil {
+			r.logger.get().Warn("Unable to revoke our etcd lease", "node", r.nodeKey, "error", err)
+		}
+	}
+
+	r.stopManager()
+}
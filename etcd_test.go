@@ -0,0 +1,356 @@
+package ringman
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEtcd starts an etcd server in the background, listening on ports
+// nobody else is using, and returns it along with its client URL
+func startEtcd(t *testing.T) (*embed.Etcd, string) {
+	clientURL, _ := url.Parse("http://" + deadAddress())
+	peerURL, _ := url.Parse("http://" + deadAddress())
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Unable to start etcd: %s", err)
+	}
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		server.Close()
+		t.Fatal("Timed out starting etcd")
+	}
+
+	return server, clientURL.String()
+}
+
+// etcdClient returns a new client of the etcd server at the URL
+func etcdClient(t *testing.T, endpoint string) *clientv3.Client {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{endpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect to etcd: %s", err)
+	}
+
+	return client
+}
+
+// waitForState waits a while for the node to be in the State in the ring
+func waitForState(ring Ring, id string, state NodeState) bool {
+	for i := 0; i < 200; i++ {
+		nodes, _ := ring.Manager().ListNodes()
+		for _, node := range nodes {
+			if node.ID == id && node.State == state {
+				return true
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return false
+}
+
+// waitForNodesWithin is like waitForNodes but waits as long as the timeout,
+// for changes that depend on leases expiring
+func waitForNodesWithin(ring Ring, count int, timeout time.Duration) []Node {
+	var nodes []Node
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		nodes, _ = ring.Manager().ListNodes()
+		if len(nodes) == count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nodes
+}
+
+func Test_EtcdRing(t *testing.T) {
+	Convey("EtcdRing", t, func() {
+		server, endpoint := startEtcd(t)
+		ctx := context.Background()
+
+		// Each ring gets a client of its own, like separate processes would
+		var clients []*clientv3.Client
+		newClient := func() *clientv3.Client {
+			client := etcdClient(t, endpoint)
+			clients = append(clients, client)
+			return client
+		}
+		client := newClient()
+
+		ring1, err := NewEtcdRing(newClient(), "10.0.0.1", &NodeMetadata{
+			ServicePort: "8000",
+			Weight:      3,
+			Zone:        "us-east-1a",
+			Labels:      map[string]string{"version": "1.2.3"},
+		})
+		So(err, ShouldBeNil)
+		logger := &recordingLogger{}
+		ring1.SetLogger(logger)
+
+		ring2, err := NewEtcdRing(newClient(), "10.0.0.2", &NodeMetadata{ServicePort: "8000"})
+		So(err, ShouldBeNil)
+		ring2.SetLogger(&recordingLogger{})
+
+		Convey("registers each node and finds the others", func() {
+			for _, ring := range []*EtcdRing{ring1, ring2} {
+				nodes := waitForNodes(ring, 2)
+				So(len(nodes), ShouldEqual, 2)
+				So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+				So(nodes[0].Address, ShouldEqual, "10.0.0.1")
+				So(nodes[0].Port, ShouldEqual, 8000)
+				So(nodes[0].Weight, ShouldEqual, 3)
+				So(nodes[0].Location.Zone, ShouldEqual, "us-east-1a")
+				So(nodes[0].Metadata["version"], ShouldEqual, "1.2.3")
+				So(nodes[1].ID, ShouldEqual, "10.0.0.2:8000")
+				So(nodes[1].Weight, ShouldEqual, DefaultNodeWeight)
+			}
+
+			resp, err := client.Get(ctx, DefaultEtcdPrefix+"10.0.0.1:8000")
+			So(err, ShouldBeNil)
+			So(len(resp.Kvs), ShouldEqual, 1)
+			So(resp.Kvs[0].Lease, ShouldNotEqual, 0)
+		})
+
+		Convey("knows its local node", func() {
+			So(ring1.LocalNode(), ShouldEqual, "10.0.0.1:8000")
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+
+			ours := keyOwnedBy(ring1.Manager(), "10.0.0.1:8000")
+			theirs := keyOwnedBy(ring1.Manager(), "10.0.0.2:8000")
+			So(ring1.IsLocal(ours), ShouldBeTrue)
+			So(ring1.IsLocal(theirs), ShouldBeFalse)
+		})
+
+		Convey("drops a node that shuts down", func() {
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+			ring2.Shutdown()
+
+			nodes := waitForNodes(ring1, 1)
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+
+			// So Reset doesn't shut it down again
+			ring2 = nil
+		})
+
+		Convey("drops a node that dies once its lease expires", func() {
+			ring3, err := NewEtcdRingWithPrefix(newClient(), DefaultEtcdPrefix, 2,
+				"10.0.0.3", &NodeMetadata{ServicePort: "8000"})
+			So(err, ShouldBeNil)
+			ring3.SetLogger(&recordingLogger{})
+			So(len(waitForNodes(ring1, 3)), ShouldEqual, 3)
+
+			// Stop keeping the lease alive, without revoking it
+			ring3.cancel()
+			<-ring3.done
+			ring3.stopManager()
+
+			nodes := waitForNodesWithin(ring1, 2, 10*time.Second)
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[1].ID, ShouldEqual, "10.0.0.2:8000")
+		})
+
+		Convey("registers again when its lease is lost", func() {
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+
+			ring2.lock.Lock()
+			lease := ring2.leaseID
+			ring2.lock.Unlock()
+
+			_, err := client.Revoke(ctx, lease)
+			So(err, ShouldBeNil)
+
+			// It drops out, then comes back on a new lease
+			for i := 0; i < 500; i++ {
+				ring2.lock.Lock()
+				newLease := ring2.leaseID
+				ring2.lock.Unlock()
+
+				if newLease != lease {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			nodes := waitForNodesWithin(ring1, 2, 5*time.Second)
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[1].ID, ShouldEqual, "10.0.0.2:8000")
+
+			resp, err := client.Get(ctx, DefaultEtcdPrefix+"10.0.0.2:8000")
+			So(err, ShouldBeNil)
+			So(len(resp.Kvs), ShouldEqual, 1)
+			So(clientv3.LeaseID(resp.Kvs[0].Lease), ShouldNotEqual, lease)
+		})
+
+		Convey("syncs from scratch when the history it watches from is compacted", func() {
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+
+			// Stop the ring's watch, so we can restart it from a stale revision
+			ring1.cancel()
+			<-ring1.done
+
+			resp, err := client.Get(ctx, DefaultEtcdPrefix)
+			So(err, ShouldBeNil)
+			staleRev := resp.Header.Revision
+
+			ring2.Shutdown()
+			ring2 = nil
+			_, err = client.Put(ctx, DefaultEtcdPrefix+"10.0.0.3:8000", `{"ServicePort": "8000"}`)
+			So(err, ShouldBeNil)
+
+			resp, err = client.Get(ctx, DefaultEtcdPrefix)
+			So(err, ShouldBeNil)
+			_, err = client.Compact(ctx, resp.Header.Revision)
+			So(err, ShouldBeNil)
+
+			watchCtx, cancel := context.WithCancel(context.Background())
+			ring1.cancel = cancel
+			ring1.done = make(chan struct{})
+			go ring1.run(watchCtx, nil, staleRev)
+
+			So(waitForState(ring1, "10.0.0.3:8000", NodeStateAlive), ShouldBeTrue)
+			So(logger.find("Lost our watch on etcd"), ShouldNotBeNil)
+			nodes, _ := ring1.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+			So(nodes[1].ID, ShouldEqual, "10.0.0.3:8000")
+
+			// And keeps watching from there
+			_, err = client.Delete(ctx, DefaultEtcdPrefix+"10.0.0.3:8000")
+			So(err, ShouldBeNil)
+			So(len(waitForNodes(ring1, 1)), ShouldEqual, 1)
+		})
+
+		Convey("goes back to the default weight when a node registers again without one", func() {
+			So(len(waitForNodes(ring2, 2)), ShouldEqual, 2)
+
+			ring1.lock.Lock()
+			ring1.meta.Weight = 0
+			ring1.lock.Unlock()
+			So(ring1.put(ctx), ShouldBeNil)
+
+			for i := 0; i < 200; i++ {
+				if snap, _ := ring2.Manager().Snapshot(); snap.Weights()["10.0.0.1:8000"] == DefaultNodeWeight {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			snap, _ := ring2.Manager().Snapshot()
+			So(snap.Weights()["10.0.0.1:8000"], ShouldEqual, DefaultNodeWeight)
+		})
+
+		Convey("tells the other nodes when it drains", func() {
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+			So(ring2.Drain(), ShouldBeNil)
+
+			So(waitForState(ring1, "10.0.0.2:8000", NodeStateDraining), ShouldBeTrue)
+
+			owner, _ := ring1.Manager().GetNode("bocaccio")
+			So(owner, ShouldEqual, "10.0.0.1:8000")
+		})
+
+		Convey("stays alive when etcd won't take its draining metadata", func() {
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+
+			ring2.lock.Lock()
+			leaseID := ring2.leaseID
+			ring2.leaseID = clientv3.LeaseID(12345) // Not a lease etcd knows about
+			ring2.lock.Unlock()
+
+			err := ring2.Drain()
+
+			ring2.lock.Lock()
+			ring2.leaseID = leaseID
+			draining := ring2.meta.Draining
+			ring2.lock.Unlock()
+
+			So(err, ShouldNotBeNil)
+			So(draining, ShouldBeFalse)
+
+			snap, _ := ring2.Manager().Snapshot()
+			node, _ := snap.Node("10.0.0.2:8000")
+			So(node.State, ShouldEqual, NodeStateAlive)
+		})
+
+		Convey("drains a node in a single change, and resumes it", func() {
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+			version := ring1.Manager().Version()
+
+			So(ring2.Drain(), ShouldBeNil)
+			So(waitForState(ring1, "10.0.0.2:8000", NodeStateDraining), ShouldBeTrue)
+			So(ring1.Manager().Version(), ShouldEqual, version+1)
+
+			ring2.lock.Lock()
+			ring2.meta.Draining = false
+			ring2.lock.Unlock()
+			So(ring2.put(context.Background()), ShouldBeNil)
+
+			So(waitForState(ring1, "10.0.0.2:8000", NodeStateAlive), ShouldBeTrue)
+			So(ring1.Manager().Version(), ShouldEqual, version+2)
+		})
+
+		Convey("applies a watch response as a single change", func() {
+			So(len(waitForNodes(ring1, 2)), ShouldEqual, 2)
+			version := ring1.Manager().Version()
+
+			put := func(id string, value string) *clientv3.Event {
+				return &clientv3.Event{Type: clientv3.EventTypePut,
+					Kv: &mvccpb.KeyValue{Key: []byte(DefaultEtcdPrefix + id), Value: []byte(value)}}
+			}
+
+			ring1.applyEvents([]*clientv3.Event{
+				put("10.0.0.3:8000", `{"ServicePort": "8000"}`),
+				put("10.0.0.4:8000", `{"ServicePort": "8000", "Draining": true}`),
+				{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte(DefaultEtcdPrefix + "10.0.0.2:8000")}},
+			})
+
+			So(ring1.Manager().Version(), ShouldEqual, version+1)
+
+			nodes, _ := ring1.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 3)
+			So(nodes[1].ID, ShouldEqual, "10.0.0.3:8000")
+			So(nodes[2].ID, ShouldEqual, "10.0.0.4:8000")
+			So(nodes[2].State, ShouldEqual, NodeStateDraining)
+		})
+
+		Convey("requires NodeMetadata", func() {
+			ring, err := NewEtcdRing(client, "10.0.0.3", nil)
+			So(err, ShouldNotBeNil)
+			So(ring, ShouldBeNil)
+		})
+
+		Reset(func() {
+			ring1.Shutdown()
+			if ring2 != nil {
+				ring2.Shutdown()
+			}
+			for _, client := range clients {
+				client.Close()
+			}
+			server.Close()
+		})
+	})
+}
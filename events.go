@@ -0,0 +1,170 @@
+package ringman
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	WatchBufferLength = 100 // How many events we queue for a slow Watch callback
+)
+
+type RingEventType int
+
+const (
+	NodeAdded   RingEventType = iota
+	NodeRemoved RingEventType = iota
+	NodeUpdated RingEventType = iota // The node's weight changed
+
+	// The Placement was replaced, which moves most keys. There is no Node.
+	PlacementChanged RingEventType = iota
+
+	NodeDraining RingEventType = iota // The node gave up owning keys
+	NodeResumed  RingEventType = iota // The node stopped draining
+)
+
+func (t RingEventType) String() string {
+	switch t {
+	case NodeAdded:
+		return "NodeAdded"
+	case NodeRemoved:
+		return "NodeRemoved"
+	case NodeUpdated:
+		return "NodeUpdated"
+	case PlacementChanged:
+		return "PlacementChanged"
+	case NodeDraining:
+		return "NodeDraining"
+	case NodeResumed:
+		return "NodeResumed"
+	default:
+		return "Unknown"
+	}
+}
+
+// A RingEvent describes a single change that was applied to the ring. Version
+// is the ring version the change produced. A batch of changes, e.g. from
+// SetNodes, produces one event per node that all share a version.
+type RingEvent struct {
+	Type    RingEventType
+	Node    string
+	Weight  int
+	Version uint64
+}
+
+// A Subscription is returned from Subscribe and Watch and is used to stop
+// receiving events.
+type Subscription struct {
+	id      uint64
+	ch      chan<- RingEvent
+	subs    *subscribers
+	dropped uint64
+	onStop  func()
+}
+
+// Dropped returns the number of events that could not be delivered because
+// the subscriber was not keeping up.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops delivery of events to this subscriber. It is safe to call
+// more than once.
+func (s *Subscription) Unsubscribe() {
+	if s.subs.remove(s.id) && s.onStop != nil {
+		s.onStop()
+	}
+}
+
+// subscribers is the registry of everyone who wants to hear about ring
+// changes. It is guarded by its own lock rather than the Run loop so that
+// callers can subscribe before the HashRingManager is running.
+type subscribers struct {
+	sync.RWMutex
+	nextId uint64
+	subs   map[uint64]*Subscription
+}
+
+func (s *subscribers) add(sub *Subscription) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.subs == nil {
+		s.subs = make(map[uint64]*Subscription)
+	}
+
+	s.nextId++
+	sub.id = s.nextId
+	sub.subs = s
+	s.subs[sub.id] = sub
+}
+
+// remove returns true if the subscription was still registered.
+func (s *subscribers) remove(id uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.subs[id]; !ok {
+		return false
+	}
+
+	delete(s.subs, id)
+	return true
+}
+
+// notify delivers the event to each subscriber without blocking. Subscribers
+// whose channels are full miss the event and have it counted as dropped.
+func (s *subscribers) notify(evt RingEvent) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, sub := range s.subs {
+		select {
+		case sub.ch <- evt:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Subscribe registers ch to receive a RingEvent for each change applied to
+// the ring. Events are sent without blocking the Run loop: if ch is full when
+// a change is applied, the event is dropped for this subscriber. Use a
+// buffered channel, and compare event versions to detect gaps. The channel is
+// never closed by the HashRingManager.
+func (r *HashRingManager) Subscribe(ch chan<- RingEvent) (*Subscription, error) {
+	if r == nil {
+		return nil, ErrNilManager
+	}
+
+	sub := &Subscription{ch: ch}
+	r.subscribers.add(sub)
+
+	return sub, nil
+}
+
+// Watch calls fn with a RingEvent for each change applied to the ring. The
+// callback is run on its own goroutine and up to WatchBufferLength events are
+// queued for it. Beyond that, events are dropped until it catches up.
+func (r *HashRingManager) Watch(fn func(RingEvent)) (*Subscription, error) {
+	if r == nil {
+		return nil, ErrNilManager
+	}
+
+	events := make(chan RingEvent, WatchBufferLength)
+	sub := &Subscription{
+		ch: events,
+		// Only called once the subscription was removed under lock, so
+		// nothing else can be sending on the channel.
+		onStop: func() { close(events) },
+	}
+	r.subscribers.add(sub)
+
+	go func() {
+		for evt := range events {
+			fn(evt)
+		}
+	}()
+
+	return sub, nil
+}
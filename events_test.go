@@ -0,0 +1,120 @@
+package ringman
+
+import (
+	"testing"
+	"time"
+
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Subscribe(t *testing.T) {
+	Convey("Subscribe()", t, func() {
+		ringMgr := NewHashRingManager([]string{"kjartan"})
+		go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+		So(ringMgr.Ping(), ShouldBeTrue)
+
+		events := make(chan RingEvent, 10)
+		sub, err := ringMgr.Subscribe(events)
+		So(err, ShouldBeNil)
+
+		Convey("delivers events for each change to the ring", func() {
+			ringMgr.AddNode("njal")
+			ringMgr.AddWeightedNode("njal", 3)
+			ringMgr.RemoveNode("kjartan")
+
+			So(<-events, ShouldResemble, RingEvent{NodeAdded, "njal", 1, 1})
+			So(<-events, ShouldResemble, RingEvent{NodeUpdated, "njal", 3, 2})
+			So(<-events, ShouldResemble, RingEvent{NodeRemoved, "kjartan", 0, 3})
+		})
+
+		Convey("does not deliver events when nothing changed", func() {
+			ringMgr.AddNode("kjartan")
+			ringMgr.RemoveNode("gunnar")
+
+			So(len(events), ShouldEqual, 0)
+		})
+
+		Convey("drops events for a subscriber that is not keeping up", func() {
+			slow := make(chan RingEvent, 1)
+			slowSub, _ := ringMgr.Subscribe(slow)
+
+			ringMgr.AddNode("njal")
+			ringMgr.AddNode("gunnar")
+			ringMgr.AddNode("hallgerd")
+
+			So(slowSub.Dropped(), ShouldEqual, 2)
+			So(sub.Dropped(), ShouldEqual, 0)
+			So(len(events), ShouldEqual, 3)
+		})
+
+		Convey("stops delivering events after Unsubscribe", func() {
+			sub.Unsubscribe()
+			sub.Unsubscribe()
+
+			ringMgr.AddNode("njal")
+			So(len(events), ShouldEqual, 0)
+		})
+
+		Convey("returns an error on a nil manager", func() {
+			var broken *HashRingManager
+			_, err := broken.Subscribe(events)
+			So(err, ShouldEqual, ErrNilManager)
+		})
+
+		Reset(func() {
+			ringMgr.Stop()
+		})
+	})
+}
+
+func Test_Watch(t *testing.T) {
+	Convey("Watch()", t, func() {
+		ringMgr := NewHashRingManager([]string{"kjartan"})
+		go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+		So(ringMgr.Ping(), ShouldBeTrue)
+
+		received := make(chan RingEvent, 10)
+		sub, err := ringMgr.Watch(func(evt RingEvent) { received <- evt })
+		So(err, ShouldBeNil)
+
+		Convey("calls the callback for each change to the ring", func() {
+			ringMgr.AddNode("njal")
+			ringMgr.RemoveNode("njal")
+
+			So(<-received, ShouldResemble, RingEvent{NodeAdded, "njal", 1, 1})
+			So(<-received, ShouldResemble, RingEvent{NodeRemoved, "njal", 0, 2})
+		})
+
+		Convey("does not block the ring on a slow callback", func() {
+			blocker := make(chan struct{})
+			slowSub, _ := ringMgr.Watch(func(evt RingEvent) { <-blocker })
+
+			for i := 0; i < WatchBufferLength+5; i++ {
+				ringMgr.AddNode("njal")
+				ringMgr.RemoveNode("njal")
+			}
+
+			So(ringMgr.Ping(), ShouldBeTrue)
+			So(slowSub.Dropped(), ShouldBeGreaterThan, 0)
+
+			slowSub.Unsubscribe()
+			close(blocker)
+		})
+
+		Convey("stops calling the callback after Unsubscribe", func() {
+			sub.Unsubscribe()
+			ringMgr.AddNode("njal")
+
+			select {
+			case <-received:
+				So("received an event", ShouldBeEmpty)
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+
+		Reset(func() {
+			ringMgr.Stop()
+		})
+	})
+}
@@ -6,34 +6,91 @@
 package ringman
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/relistan/go-director"
 	"github.com/serialx/hashring"
 )
 
 var (
+	ErrBadCount   error = errors.New("Must request at least one node")
 	ErrNilManager error = errors.New("HashRingManager has not been initialized!")
+	ErrNoNodes    error = errors.New("No nodes in ring!")
+	ErrNoRing     error = errors.New("HashRingManager has no ring. May not be initialized!")
+	ErrNotRunning error = errors.New("HashRingManager has a nil command channel. May not be initialized!")
+	ErrNotStarted error = errors.New("HashRingManager was not run within StartTimeout")
+	ErrStopped    error = errors.New("HashRingManager was stopped")
 )
 
 const (
 	CmdAddNode    = iota
 	CmdRemoveNode = iota
-	CmdGetNode    = iota
-	CmdPing       = iota
+
+	// Deprecated: Lookups are served from the ring snapshot and no longer
+	// pass through the Run loop, which rejects this command. Use GetNode or
+	// Snapshot instead.
+	CmdGetNode = iota
+
+	CmdPing = iota
+
+	// Deprecated: Lookups are served from the ring snapshot and no longer
+	// pass through the Run loop, which rejects this command. Use GetNodes or
+	// Snapshot instead.
+	CmdGetNodes = iota
+
+	CmdSetPlacement = iota
+	CmdSetDraining  = iota
+	CmdSetNodes     = iota
+	CmdApplyDiff    = iota
 )
 
 const (
 	CommandChannelLength = 10                   // How big a buffer on our mailbox channel?
 	PingTimeout          = 5 * time.Millisecond // This should be PLENTY of spare time
+	StartTimeout         = 1 * time.Second      // How long commands wait for a manager that was never run
 )
 
+// A HashRingManager serializes all changes to the ring through the Run loop.
+// After each change it builds a new Placement and publishes it as an
+// immutable snapshot, which lookups read without locking or going through the
+// Run loop.
 type HashRingManager struct {
-	HashRing *hashring.HashRing
-	cmdChan  chan RingCommand
+	// HashRing is the ring behind the default hashring Placement. It is nil
+	// when the manager uses a different Placement.
+	//
+	// Deprecated: The Run loop replaces it on every change, so reading it
+	// while the manager is running is a data race. Use Snapshot instead.
+	HashRing    *hashring.HashRing
+	cmdChan     chan RingCommand
+	snapshot    atomic.Value        // Always holds a *RingSnapshot
+	version     uint64              // Only touched from the Run loop
+	weights     map[string]int      // Only touched from the Run loop
+	locations   map[string]Location // Only touched from the Run loop
+	infos       map[string]Node     // Only touched from the Run loop
+	placementFn PlacementFunc       // Only touched from the Run loop
+	placement   Placement           // Only touched from the Run loop
+	draining    map[string]bool     // Only touched from the Run loop
+	handoff     Placement           // Only touched from the Run loop
+	subscribers subscribers
+	loads       loadTracker
+	metrics     atomic.Value // Holds the *Metrics, if NewMetrics was called
+	logger      loggerRef
+
+	// The lifecycle lock guards the state and the channels for the current
+	// run. Senders only hold it while reading those, and then watch them
+	// for the run to end while they wait on the command channel.
+	lifecycle sync.RWMutex
+	state     ManagerState
+	started   chan struct{} // Closed the first time it is run
+	quit      chan struct{}
+	exited    chan struct{} // Closed when the Run loop exits, before finish runs
+	done      chan struct{}
 }
 
 type RingCommand struct {
@@ -41,6 +98,17 @@ type RingCommand struct {
 	NodeName  string
 	Key       string
 	ReplyChan chan *RingReply
+	Count     int
+	Weight    int
+	Placement PlacementFunc
+	Location  *Location // Leaves the node's Location alone when nil
+	Draining  bool
+	Nodes     map[string]int  // Node weights for CmdSetNodes and CmdApplyDiff
+	Remove    []string        // Nodes to remove for CmdApplyDiff
+	Info      *Node           // What the backend knows about the node for CmdAddNode
+	Infos     map[string]Node // The same, by node, for CmdSetNodes and CmdApplyDiff
+
+	run <-chan struct{} // The done channel of the run it was sent to
 }
 
 type RingReply struct {
@@ -50,143 +118,832 @@ type RingReply struct {
 
 type Ring interface {
 	HttpMux() *http.ServeMux
+
+	// Shutdown stops the ring and its HashRingManager. It is safe to call
+	// more than once.
 	Shutdown()
 	Manager() *HashRingManager
+
+	// LocalNode returns this node's name in the ring, or "" if it isn't
+	// known yet.
+	LocalNode() string
+
+	// IsLocal reports whether this node owns the key.
+	IsLocal(key string) bool
+}
+
+// isLocal reports whether localNode owns the key in the manager's ring.
+func isLocal(manager *HashRingManager, localNode string, key string) bool {
+	if localNode == "" {
+		return false
+	}
+
+	owner, err := manager.GetNode(key)
+	return err == nil && owner == localNode
 }
 
 // NewHashRingManager returns a properly configured HashRingManager. It accepts
 // zero or mode nodes to initialize the ring with.
 func NewHashRingManager(nodeList []string) *HashRingManager {
-	return &HashRingManager{
-		HashRing: hashring.New(nodeList),
-		cmdChan:  make(chan RingCommand, CommandChannelLength),
+	weights := make(map[string]int, len(nodeList))
+	for _, node := range nodeList {
+		weights[node] = DefaultNodeWeight
+	}
+
+	return NewHashRingManagerWithPlacement(weights, NewHashringPlacement)
+}
+
+// NewWeightedHashRingManager returns a properly configured HashRingManager
+// whose ring is initialized with the nodes and weights provided. Nodes with
+// a higher weight own a proportionally larger share of the ring.
+func NewWeightedHashRingManager(weights map[string]int) *HashRingManager {
+	return NewHashRingManagerWithPlacement(weights, NewHashringPlacement)
+}
+
+// NewHashRingManagerWithPlacement returns a properly configured
+// HashRingManager that places keys on nodes using the PlacementFunc provided,
+// e.g. NewRendezvousPlacement. The ring is initialized with the nodes and
+// weights provided, which may be nil. If placementFn is nil, the default
+// hashring placement is used.
+func NewHashRingManagerWithPlacement(weights map[string]int, placementFn PlacementFunc) *HashRingManager {
+	if placementFn == nil {
+		placementFn = NewHashringPlacement
+	}
+
+	ownWeights := make(map[string]int, len(weights))
+	for node, weight := range weights {
+		if weight < 1 {
+			weight = DefaultNodeWeight
+		}
+		ownWeights[node] = weight
+	}
+
+	mgr := &HashRingManager{
+		cmdChan:     make(chan RingCommand, CommandChannelLength),
+		weights:     ownWeights,
+		locations:   make(map[string]Location),
+		infos:       make(map[string]Node),
+		draining:    make(map[string]bool),
+		started:     make(chan struct{}),
+		done:        make(chan struct{}),
+		placementFn: placementFn,
 	}
+	mgr.rebuild()
+	mgr.publish()
+
+	return mgr
 }
 
 // Run runs in a loop over the contents of cmdChan and processes the
-// incoming work. This acts as the synchronization around the HashRing
-// itself which is not mutable and has to be replaced on each command.
+// incoming work. This acts as the synchronization around changes to the
+// ring. The Placement is not mutable and has to be replaced on each
+// change. Each replacement is published for lookups to read. Run returns
+// once the manager is stopped or the looper finishes, and can then be called
+// again to restart the manager. Commands are rejected until it does, so
+// prefer Start or Restart, which return once the manager is running.
 func (r *HashRingManager) Run(looper director.Looper) error {
 	if r == nil {
 		return ErrNilManager
 	}
 
-	// The cmdChan is used to synchronize all the access to the HashRing
+	quit, exited, err := r.begin()
+	if err != nil {
+		return err
+	}
+
+	r.loop(looper, quit, exited)
+
+	return nil
+}
+
+// loop processes commands until the quit channel is closed or the looper
+// finishes, then moves the manager into the stopped state.
+func (r *HashRingManager) loop(looper director.Looper, quit chan struct{}, exited chan struct{}) {
+	defer r.finish()
+
+	// Senders waiting on a full command channel give up as soon as we're
+	// done taking commands, without waiting for finish.
+	defer close(exited)
+
+	// The cmdChan is used to synchronize all the changes to the ring
 	looper.Loop(func() error {
-		if r.cmdChan == nil {
-			return errors.New("Command processor was stopped")
+		select {
+		case msg := <-r.cmdChan:
+			// Senders don't hold the lifecycle lock, so one may have
+			// slipped a command in just as an earlier run was stopped
+			if msg.isStale() {
+				msg.reject()
+				return nil
+			}
+
+			r.process(msg)
+			return nil
+		case <-quit:
+			return ErrStopped
 		}
+	})
 
-		msg := <-r.cmdChan
+	r.logger.get().Warn("Ringman command processor stopped", "version", r.Version())
+}
+
+// process applies a single command. It must only be called from the Run
+// loop.
+func (r *HashRingManager) process(msg RingCommand) {
+	// Commands that don't change anything don't get a new version, and
+	// there is nothing to tell anyone about.
+	var events []RingEvent
+	record := func(evt RingEvent, changed bool) {
+		if changed {
+			events = append(events, evt)
+		}
+	}
 
-		switch msg.Command {
-		case CmdAddNode:
-			log.Debugf("Adding node %s", msg.NodeName)
-			r.HashRing = r.HashRing.AddNode(msg.NodeName)
+	switch msg.Command {
+	case CmdAddNode:
+		record(r.addNode(msg.NodeName, msg.Weight, msg.Location, msg.Info))
+		if msg.Info != nil {
+			record(r.setState(msg.NodeName, msg.Info.State))
+		}
 
-		case CmdRemoveNode:
-			log.Debugf("Removing node %s", msg.NodeName)
-			r.HashRing = r.HashRing.RemoveNode(msg.NodeName)
+	case CmdRemoveNode:
+		record(r.removeNode(msg.NodeName))
 
-		case CmdGetNode:
-			node, ok := r.HashRing.GetNode(msg.Key)
-			var err error
-			if !ok {
-				err = errors.New("No nodes in ring!")
+	case CmdSetNodes:
+		for _, name := range sortedNodes(r.weights) {
+			if _, ok := msg.Nodes[name]; !ok {
+				record(r.removeNode(name))
 			}
+		}
+
+		r.addNodes(msg.Nodes, msg.Infos, record)
+
+	case CmdApplyDiff:
+		for _, name := range msg.Remove {
+			record(r.removeNode(name))
+		}
+
+		r.addNodes(msg.Nodes, msg.Infos, record)
+
+	case CmdSetPlacement:
+		r.logger.get().Debug("Changing placement")
+		r.placementFn = msg.Placement
+		record(RingEvent{Type: PlacementChanged}, true)
+
+	case CmdSetDraining:
+		record(r.setDraining(msg.NodeName, msg.Draining))
 
-			msg.ReplyChan <- &RingReply{
-				Error: err,
-				Nodes: []string{node},
+	case CmdPing:
+		msg.ReplyChan <- &RingReply{}
+
+	default:
+		r.logger.get().Error("Received unexpected command", "command", msg.Command)
+	}
+
+	// However many nodes changed, the ring is only rebuilt once, and
+	// readers never see it part way through.
+	if len(events) > 0 {
+		r.rebuild()
+		r.version++
+		r.publish()
+		r.logger.get().Debug("Published new ring", "version", r.version, "changes", len(events))
+
+		metrics := r.Metrics()
+		for _, evt := range events {
+			evt.Version = r.version
+			r.subscribers.notify(evt)
+
+			if metrics != nil {
+				metrics.recordChange(evt)
 			}
+		}
+	}
 
-		case CmdPing:
-			msg.ReplyChan <- &RingReply{}
+	// Let the sender of a change know it has been published
+	if msg.Command != CmdPing && msg.ReplyChan != nil {
+		msg.ReplyChan <- &RingReply{}
+	}
+}
 
-		default:
-			log.Errorf("Received unexpected command %d", msg.Command)
+// addNode adds the node, or updates its weight, Location and info if it is
+// already in the ring. A weight below 1 leaves the weight of an existing node
+// alone, and a nil Location or info leaves those alone. It returns false if
+// nothing changed.
+func (r *HashRingManager) addNode(name string, weight int, loc *Location, info *Node) (RingEvent, bool) {
+	oldWeight, exists := r.weights[name]
+	if weight < 1 {
+		weight = DefaultNodeWeight
+		if exists {
+			weight = oldWeight
 		}
+	}
 
-		return nil
-	})
+	oldLocation := r.locations[name]
+	location := oldLocation
+	if loc != nil {
+		location = *loc
+	}
 
-	log.Warnf("ringman closed cmdChan")
+	oldInfo, hasInfo := r.infos[name]
+	infoChanged := info != nil && (!hasInfo || !info.sameInfo(&oldInfo))
 
-	return nil
+	if exists && weight == oldWeight && location == oldLocation && !infoChanged {
+		return RingEvent{}, false
+	}
+
+	evt := RingEvent{Type: NodeAdded, Node: name, Weight: weight}
+	if exists {
+		evt.Type = NodeUpdated
+	}
+
+	r.logger.get().Debug("Adding node", "node", name, "weight", weight)
+	r.weights[name] = weight
+	r.setLocation(name, location)
+	if info != nil {
+		r.infos[name] = *info
+	}
+
+	return evt, true
+}
+
+// addNodes adds or updates each of the nodes, along with its Node if there
+// is one in infos, and records what changed.
+func (r *HashRingManager) addNodes(weights map[string]int, infos map[string]Node,
+	record func(RingEvent, bool)) {
+
+	for _, name := range sortedNodes(weights) {
+		if info, ok := infos[name]; ok {
+			record(r.addNode(name, weights[name], &info.Location, &info))
+			record(r.setState(name, info.State))
+			continue
+		}
+
+		record(r.addNode(name, weights[name], nil, nil))
+	}
+}
+
+// removeNode removes the node and everything we know about it. It returns
+// false if the node wasn't in the ring.
+func (r *HashRingManager) removeNode(name string) (RingEvent, bool) {
+	if _, exists := r.weights[name]; !exists {
+		return RingEvent{}, false
+	}
+
+	r.logger.get().Debug("Removing node", "node", name)
+	delete(r.weights, name)
+	delete(r.locations, name)
+	delete(r.draining, name)
+	delete(r.infos, name)
+
+	return RingEvent{Type: NodeRemoved, Node: name}, true
+}
+
+// setDraining marks the node as draining or not. It returns false if the node
+// isn't in the ring or was already in that state.
+func (r *HashRingManager) setDraining(name string, draining bool) (RingEvent, bool) {
+	weight, exists := r.weights[name]
+	if !exists || r.draining[name] == draining {
+		return RingEvent{}, false
+	}
+
+	evt := RingEvent{Node: name, Weight: weight}
+	if draining {
+		r.logger.get().Debug("Draining node", "node", name)
+		r.draining[name] = true
+		evt.Type = NodeDraining
+	} else {
+		r.logger.get().Debug("Node is no longer draining", "node", name)
+		delete(r.draining, name)
+		evt.Type = NodeResumed
+	}
+
+	return evt, true
+}
+
+// setState drains or resumes the node to match the State the backend gave
+// it. An empty State leaves it as it is.
+func (r *HashRingManager) setState(name string, state NodeState) (RingEvent, bool) {
+	switch state {
+	case NodeStateDraining:
+		return r.setDraining(name, true)
+	case NodeStateAlive:
+		return r.setDraining(name, false)
+	}
+
+	return RingEvent{}, false
+}
+
+// rebuild replaces the Placement with one for the current nodes and weights.
+// Draining nodes are left out, but get a handoff Placement of their own that
+// still includes them.
+func (r *HashRingManager) rebuild() {
+	r.placement = r.placementFn(r.activeWeights())
+
+	r.handoff = nil
+	if len(r.draining) > 0 {
+		r.handoff = r.placementFn(r.weights)
+	}
+
+	r.HashRing = nil
+	if ring, ok := r.placement.(*hashringPlacement); ok {
+		r.HashRing = ring.ring
+	}
+}
+
+// publish makes the current Placement available to lookups. The Placement
+// is replaced rather than modified on each change, so readers holding an
+// older snapshot are never affected.
+func (r *HashRingManager) publish() {
+	snap := newRingSnapshot(r.version, r.placement, r.activeWeights(), r.locations)
+	snap.nodes = r.nodeInfos()
+	if r.handoff != nil {
+		snap.handoff = r.handoff
+		snap.draining = make(map[string]bool, len(r.draining))
+		for node := range r.draining {
+			snap.draining[node] = true
+		}
+	}
+
+	r.snapshot.Store(snap)
+}
+
+// activeWeights returns the weights of the nodes that are not draining. If
+// every node is draining, there is nowhere else for keys to go and they all
+// stay.
+func (r *HashRingManager) activeWeights() map[string]int {
+	if len(r.draining) == 0 || len(r.draining) == len(r.weights) {
+		return r.weights
+	}
+
+	active := make(map[string]int, len(r.weights)-len(r.draining))
+	for node, weight := range r.weights {
+		if !r.draining[node] {
+			active[node] = weight
+		}
+	}
+
+	return active
+}
+
+// setLocation records where the node runs. Only nodes with a known Location
+// are kept, so that lookups can cheaply tell when there are none.
+func (r *HashRingManager) setLocation(node string, loc Location) {
+	if loc == (Location{}) {
+		delete(r.locations, node)
+		return
+	}
+
+	r.locations[node] = loc
+}
+
+// SetLogger sets the Logger the HashRingManager writes to. Until it is
+// called, the default Logger is used.
+func (r *HashRingManager) SetLogger(logger Logger) {
+	if r == nil {
+		return
+	}
+
+	r.logger.set(logger)
+}
+
+// Snapshot returns the most recently published snapshot of the ring.
+func (r *HashRingManager) Snapshot() (*RingSnapshot, error) {
+	if r == nil {
+		return nil, ErrNilManager
+	}
+
+	snap, ok := r.snapshot.Load().(*RingSnapshot)
+	if !ok || snap == nil {
+		return nil, ErrNoRing
+	}
+
+	return snap, nil
 }
 
 // Pending returns the number of pending commands in the command channel
 func (r *HashRingManager) Pending() int {
+	if r == nil {
+		return 0
+	}
+
 	return len(r.cmdChan)
 }
 
-// Stop the HashRingManager from running. This is currently permanent since
-// the internal cmdChan it closes can't be re-opened.
-func (r *HashRingManager) Stop() {
-	if r.cmdChan != nil {
-		close(r.cmdChan)
-		r.cmdChan = nil // Prevent issues reading on closed channel
+// A commandRun holds what a sender needs to know about the run of the
+// manager it sent a command to, so it can tell when to give up.
+type commandRun struct {
+	started    <-chan struct{}  // Nil once the manager has been run
+	notStarted <-chan time.Time // Fires after StartTimeout if it still hasn't
+	timer      *time.Timer
+	exited     <-chan struct{}
+	done       <-chan struct{}
+}
+
+// stop releases the timer for the start timeout, if there is one.
+func (run *commandRun) stop() {
+	if run.timer != nil {
+		run.timer.Stop()
 	}
 }
 
-// wrapCommand handles validation of dependencies for the various commands.
-func (r *HashRingManager) wrapCommand(fn func() error) error {
+// currentRun handles validation of dependencies for the various commands,
+// and returns the channels for the current run. The lifecycle lock is only
+// held while reading them, never while sending, so that a sender waiting on
+// a full command channel can't hold up Start or Stop.
+func (r *HashRingManager) currentRun() (*commandRun, error) {
 	if r == nil {
-		return ErrNilManager
+		return nil, ErrNilManager
 	}
 	if r.cmdChan == nil {
-		return errors.New("HashRingManager has a nil command channel. May not be initialized!")
+		return nil, ErrNotRunning
+	}
+
+	r.lifecycle.RLock()
+	defer r.lifecycle.RUnlock()
+
+	if r.state == ManagerStopping || r.state == ManagerStopped {
+		return nil, ErrStopped
+	}
+
+	run := &commandRun{exited: r.exited, done: r.done}
+
+	select {
+	case <-r.started:
+	default:
+		run.started = r.started
+		run.timer = time.NewTimer(StartTimeout)
+		run.notStarted = run.timer.C
 	}
 
-	return fn()
+	return run, nil
+}
+
+// send puts a command on the command channel. It gives up if the manager
+// stops, when the context is done, or with ErrNotStarted if the manager still
+// hasn't been run after StartTimeout.
+func (r *HashRingManager) send(ctx context.Context, cmd RingCommand, run *commandRun) error {
+	tagged := cmd
+	tagged.run = run.done
+
+	for {
+		select {
+		case r.cmdChan <- tagged:
+			return nil
+		case <-run.exited:
+			return ErrStopped
+		case <-run.done:
+			return ErrStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-run.started:
+			// It's running, so wait as long as it takes
+			run.started, run.notStarted = nil, nil
+		case <-run.notStarted:
+			return ErrNotStarted
+		}
+	}
+}
+
+// waitForReply waits for the Run loop to answer a command. Commands left
+// over when the manager stops are answered with ErrStopped, but we check
+// done as well in case ours was never seen. If the manager has never been
+// run, we only wait until StartTimeout for it to start.
+func (r *HashRingManager) waitForReply(ctx context.Context, replyChan chan *RingReply,
+	run *commandRun) (*RingReply, error) {
+
+	for {
+		select {
+		case reply := <-replyChan:
+			return reply, nil
+		case <-run.done:
+			select {
+			case reply := <-replyChan:
+				return reply, nil
+			default:
+				return nil, ErrStopped
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-run.started:
+			// It's running, so wait as long as it takes
+			run.started, run.notStarted = nil, nil
+		case <-run.notStarted:
+			return nil, ErrNotStarted
+		}
+	}
+}
+
+// sendChange sends a change on the message channel for the HashManager and
+// waits for it to be published, so that lookups made afterward will see it.
+// It gives up when the context is done and returns the context's error, or
+// with ErrNotStarted if the manager still hasn't been run after StartTimeout,
+// whether the change was sent or is still waiting for room in the channel.
+// The change may still be applied later if it was already sent.
+func (r *HashRingManager) sendChange(ctx context.Context, cmd RingCommand) error {
+	run, err := r.currentRun()
+	if err != nil {
+		return err
+	}
+	defer run.stop()
+
+	// Buffered so the Run loop never blocks replying to someone who left
+	replyChan := make(chan *RingReply, 1)
+	cmd.ReplyChan = replyChan
+
+	err = r.send(ctx, cmd, run)
+	if err != nil {
+		return err
+	}
+
+	reply, err := r.waitForReply(ctx, replyChan, run)
+	if err != nil {
+		return err
+	}
+
+	return reply.Error
 }
 
 // AddNode is a blocking call that will send an add message on the message
-// channel for the HashManager.
+// channel for the HashManager and wait for it to be applied. If the manager
+// has never been run, it waits up to StartTimeout for it to start, then
+// returns ErrNotStarted.
 func (r *HashRingManager) AddNode(nodeName string) error {
-	return r.wrapCommand(func() error {
-		r.cmdChan <- RingCommand{CmdAddNode, nodeName, "", nil}
-		return nil
-	})
+	return r.AddNodeContext(context.Background(), nodeName)
+}
+
+// AddNodeContext is like AddNode but gives up when the context is done.
+func (r *HashRingManager) AddNodeContext(ctx context.Context, nodeName string) error {
+	return r.sendChange(ctx, RingCommand{Command: CmdAddNode, NodeName: nodeName})
+}
+
+// AddWeightedNode is a blocking call that will send an add message with a
+// weight on the message channel for the HashManager and wait for it to be
+// applied. If the node is already in the ring, its weight is updated instead.
+func (r *HashRingManager) AddWeightedNode(nodeName string, weight int) error {
+	return r.AddWeightedNodeContext(context.Background(), nodeName, weight)
+}
+
+// AddWeightedNodeContext is like AddWeightedNode but gives up when the
+// context is done.
+func (r *HashRingManager) AddWeightedNodeContext(ctx context.Context, nodeName string, weight int) error {
+	if weight < 1 {
+		return errors.New("Node weight must be at least 1")
+	}
+
+	return r.sendChange(ctx, RingCommand{Command: CmdAddNode, NodeName: nodeName, Weight: weight})
 }
 
-// RemoveNode is a blocking call that will send an add message on the message
-// channel for the HashManager.
+// RemoveNode is a blocking call that will send a remove message on the
+// message channel for the HashManager and wait for it to be applied. Like
+// AddNode, it waits up to StartTimeout for a manager that has never been run.
 func (r *HashRingManager) RemoveNode(nodeName string) error {
-	return r.wrapCommand(func() error {
-		r.cmdChan <- RingCommand{CmdRemoveNode, nodeName, "", nil}
-		return nil
+	return r.RemoveNodeContext(context.Background(), nodeName)
+}
+
+// RemoveNodeContext is like RemoveNode but gives up when the context is done.
+func (r *HashRingManager) RemoveNodeContext(ctx context.Context, nodeName string) error {
+	return r.sendChange(ctx, RingCommand{Command: CmdRemoveNode, NodeName: nodeName})
+}
+
+// SetNodes is a blocking call that replaces the membership of the ring with
+// the nodes and weights provided, and waits for it to be applied. Nodes not
+// in the map are removed. However many nodes change, the ring is rebuilt
+// once and gets a single new version, so lookups never see it half done. A
+// weight below 1 leaves the weight of a node already in the ring alone, and
+// gives a new node the DefaultNodeWeight.
+func (r *HashRingManager) SetNodes(weights map[string]int) error {
+	return r.SetNodesContext(context.Background(), weights)
+}
+
+// SetNodesContext is like SetNodes but gives up when the context is done.
+func (r *HashRingManager) SetNodesContext(ctx context.Context, weights map[string]int) error {
+	return r.sendChange(ctx, RingCommand{Command: CmdSetNodes, Nodes: copyWeights(weights)})
+}
+
+// ApplyDiff is a blocking call that removes some nodes from the ring and adds
+// or updates others, all at once like SetNodes does, and waits for it to be
+// applied. Removals are applied first, so a node in both is kept.
+func (r *HashRingManager) ApplyDiff(add map[string]int, remove []string) error {
+	return r.ApplyDiffContext(context.Background(), add, remove)
+}
+
+// ApplyDiffContext is like ApplyDiff but gives up when the context is done.
+func (r *HashRingManager) ApplyDiffContext(ctx context.Context, add map[string]int, remove []string) error {
+	return r.sendChange(ctx, RingCommand{
+		Command: CmdApplyDiff,
+		Nodes:   copyWeights(add),
+		Remove:  append([]string(nil), remove...),
 	})
 }
 
-// GetNode requests a node from the ring to serve the provided key
+// copyWeights copies the map so the caller can't change it under the Run
+// loop, e.g. after giving up on a command.
+func copyWeights(weights map[string]int) map[string]int {
+	copied := make(map[string]int, len(weights))
+	for node, weight := range weights {
+		copied[node] = weight
+	}
+
+	return copied
+}
+
+// SetPlacement is a blocking call that replaces the way keys are placed on
+// nodes, e.g. with NewMaglevPlacement, and waits for it to be applied. This
+// moves most keys to a new owner, so it's best done before the ring is in
+// use, e.g. right after creating a MemberlistRing or SidecarRing.
+func (r *HashRingManager) SetPlacement(placementFn PlacementFunc) error {
+	return r.SetPlacementContext(context.Background(), placementFn)
+}
+
+// SetPlacementContext is like SetPlacement but gives up when the context is
+// done.
+func (r *HashRingManager) SetPlacementContext(ctx context.Context, placementFn PlacementFunc) error {
+	if placementFn == nil {
+		return errors.New("PlacementFunc must not be nil")
+	}
+
+	return r.sendChange(ctx, RingCommand{Command: CmdSetPlacement, Placement: placementFn})
+}
+
+// GetNode returns the node from the ring that serves the provided key. It
+// reads the latest ring snapshot and does not wait on the Run loop. With
+// SetBoundedLoad turned on, overloaded nodes are passed over for the next
+// one in ring order.
 func (r *HashRingManager) GetNode(key string) (string, error) {
-	replyChan := make(chan *RingReply)
-	err := r.wrapCommand(func() error {
-		r.cmdChan <- RingCommand{CmdGetNode, "", key, replyChan}
-		return nil
-	})
+	node, _, err := r.GetNodeWithVersion(key)
+	return node, err
+}
+
+// GetNodeWithVersion is like GetNode but also returns the version of the ring
+// the answer came from. Two answers with the same version came from the same
+// ring, and a higher version means the membership has changed since.
+func (r *HashRingManager) GetNodeWithVersion(key string) (string, uint64, error) {
+	if metrics := r.Metrics(); metrics != nil {
+		defer metrics.recordLookup(time.Now())
+	}
 
+	snap, err := r.Snapshot()
 	if err != nil {
+		return "", 0, err
+	}
+
+	node, err := r.nodeFromSnapshot(snap, key)
+	return node, snap.Version, err
+}
+
+// nodeFromSnapshot returns the owner of the key in the snapshot, passing over
+// overloaded nodes when bounded loads are on.
+func (r *HashRingManager) nodeFromSnapshot(snap *RingSnapshot, key string) (string, error) {
+	if epsilon := r.loads.getEpsilon(); epsilon > 0 {
+		return r.loads.boundedNode(snap, key, epsilon)
+	}
+
+	return snap.GetNode(key)
+}
+
+// nodesFromSnapshot returns up to count nodes for the key from the snapshot.
+// When bounded loads are on, the first is the one nodeFromSnapshot picks, so
+// it always agrees with GetNode, and the rest follow in their usual order.
+func (r *HashRingManager) nodesFromSnapshot(snap *RingSnapshot, key string, count int) ([]string, error) {
+	nodes, err := snap.GetNodes(key, count)
+	epsilon := r.loads.getEpsilon()
+	if err != nil || epsilon <= 0 {
+		return nodes, err
+	}
+
+	owner, err := r.loads.boundedNode(snap, key, epsilon)
+	if err != nil {
+		return nil, err
+	}
+
+	bounded := append(make([]string, 0, len(nodes)), owner)
+	for _, node := range nodes {
+		if node != owner && len(bounded) < len(nodes) {
+			bounded = append(bounded, node)
+		}
+	}
+
+	return bounded, nil
+}
+
+// GetNodeContext is like GetNode but returns the context's error if it is
+// already done. Lookups never wait on the Run loop, so there is nothing else
+// to cancel.
+func (r *HashRingManager) GetNodeContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
 		return "", err
 	}
 
-	reply := <-replyChan
-	close(replyChan)
-	replyChan = nil
+	return r.GetNode(key)
+}
+
+// GetNodes returns up to count distinct nodes from the ring to serve the
+// provided key, in ring order starting with the node that owns it. This is
+// useful when storing replicas. If the ring contains fewer than count nodes,
+// all of them are returned. Like GetNode, it reads the latest ring snapshot.
+// With SetBoundedLoad turned on, the first node is always the one GetNode
+// would return, even when that isn't the owner.
+func (r *HashRingManager) GetNodes(key string, count int) ([]string, error) {
+	nodes, _, err := r.GetNodesWithVersion(key, count)
+	return nodes, err
+}
+
+// GetNodesWithVersion is like GetNodes but also returns the version of the
+// ring the answer came from.
+func (r *HashRingManager) GetNodesWithVersion(key string, count int) ([]string, uint64, error) {
+	if count < 1 {
+		return nil, 0, ErrBadCount
+	}
+
+	snap, err := r.Snapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nodes, err := r.nodesFromSnapshot(snap, key, count)
+	return nodes, snap.Version, err
+}
+
+// Version returns the current version of the ring. It starts at 0 and goes
+// up by one with each change to the ring, and is kept across restarts.
+func (r *HashRingManager) Version() uint64 {
+	snap, err := r.Snapshot()
+	if err != nil {
+		return 0
+	}
+
+	return snap.Version
+}
+
+// GetNodesContext is like GetNodes but returns the context's error if it is
+// already done.
+func (r *HashRingManager) GetNodesContext(ctx context.Context, key string, count int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	return reply.Nodes[0], reply.Error
+	return r.GetNodes(key, count)
 }
 
 // Ping is a simple ping through the main processing loop with a timeout to make
 // sure this thing is running the background goroutine.
 func (r *HashRingManager) Ping() bool {
-	replyChan := make(chan *RingReply)
-	select {
-	case r.cmdChan <- RingCommand{CmdPing, "", "", replyChan}:
-		<-replyChan
-		return true
-	case <-time.After(PingTimeout):
+	run, err := r.currentRun()
+	if err != nil {
+		return false
+	}
+	defer run.stop()
+
+	replyChan := make(chan *RingReply, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+
+	err = r.send(ctx, RingCommand{Command: CmdPing, ReplyChan: replyChan}, run)
+	if err != nil {
 		return false
 	}
+
+	reply, err := r.waitForReply(ctx, replyChan, run)
+	return err == nil && reply.Error == nil
+}
+
+// PingContext makes a round trip through the main processing loop. It returns
+// nil if the loop is running, or the context's error if the loop didn't
+// answer before the context was done.
+func (r *HashRingManager) PingContext(ctx context.Context) error {
+	run, err := r.currentRun()
+	if err != nil {
+		return err
+	}
+	defer run.stop()
+
+	replyChan := make(chan *RingReply, 1)
+
+	err = r.send(ctx, RingCommand{Command: CmdPing, ReplyChan: replyChan}, run)
+	if err != nil {
+		return err
+	}
+
+	reply, err := r.waitForReply(ctx, replyChan, run)
+	if err != nil {
+		return err
+	}
+
+	return reply.Error
+}
+
+// replicasFromRequest returns the number of replicas requested in the
+// replicas parameter of an HTTP request, or 0 if none were requested.
+func replicasFromRequest(req *http.Request) (int, error) {
+	replicasStr := req.FormValue("replicas")
+	if replicasStr == "" {
+		return 0, nil
+	}
+
+	replicas, err := strconv.Atoi(replicasStr)
+	if err != nil || replicas < 1 {
+		return 0, errors.New("Invalid replicas count: " + replicasStr)
+	}
+
+	return replicas, nil
 }
@@ -1,7 +1,10 @@
 package ringman
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	director "github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
@@ -19,6 +22,25 @@ func Test_NewHashRingManager(t *testing.T) {
 	})
 }
 
+func Test_NewWeightedHashRingManager(t *testing.T) {
+	Convey("NewWeightedHashRingManager()", t, func() {
+		ringMgr := NewWeightedHashRingManager(map[string]int{"njal": 1, "kjartan": 9})
+
+		Convey("returns a ring that favors the heavier nodes", func() {
+			So(ringMgr.cmdChan, ShouldNotBeNil)
+			So(ringMgr.HashRing.Size(), ShouldEqual, 2)
+
+			counts := make(map[string]int)
+			for i := 0; i < 1000; i++ {
+				node, _ := ringMgr.HashRing.GetNode(fmt.Sprintf("key-%d", i))
+				counts[node]++
+			}
+
+			So(counts["kjartan"], ShouldBeGreaterThan, counts["njal"]*3)
+		})
+	})
+}
+
 func Test_Run(t *testing.T) {
 	Convey("Run()", t, func() {
 		hostList := []string{"njal", "kjartan"}
@@ -34,7 +56,8 @@ func Test_Run(t *testing.T) {
 			So(ringMgr.Ping(), ShouldBeTrue)
 
 			ringMgr.Stop()
-			So(ringMgr.cmdChan, ShouldBeNil)
+			<-ringMgr.Done()
+			So(ringMgr.State(), ShouldEqual, ManagerStopped)
 
 			So(ringMgr.Ping(), ShouldBeFalse)
 		})
@@ -44,6 +67,69 @@ func Test_Run(t *testing.T) {
 			So(func() { broken.Run(nil) }, ShouldNotPanic)
 		})
 	})
+
+	Convey("Run() with more commands waiting than the channel holds", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal"})
+
+		count := CommandChannelLength + 5
+		errs := make(chan error, count)
+		for i := 0; i < count; i++ {
+			go func(i int) { errs <- ringMgr.AddNode(fmt.Sprintf("node-%d", i)) }(i)
+		}
+
+		for ringMgr.Pending() < CommandChannelLength {
+			time.Sleep(time.Millisecond)
+		}
+
+		// returns runs the function and reports whether it returned in time
+		returns := func(fn func()) bool {
+			finished := make(chan struct{})
+			go func() {
+				fn()
+				close(finished)
+			}()
+
+			select {
+			case <-finished:
+				return true
+			case <-time.After(time.Second):
+				return false
+			}
+		}
+
+		Convey("can be started, and applies them all", func() {
+			So(returns(func() { ringMgr.Start() }), ShouldBeTrue)
+
+			for i := 0; i < count; i++ {
+				So(<-errs, ShouldBeNil)
+			}
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Size(), ShouldEqual, count+1)
+
+			ringMgr.Stop()
+			<-ringMgr.Done()
+		})
+
+		Convey("can be stopped, and rejects them all", func() {
+			So(returns(ringMgr.Stop), ShouldBeTrue)
+			So(ringMgr.State(), ShouldEqual, ManagerStopped)
+
+			for i := 0; i < count; i++ {
+				So(<-errs, ShouldEqual, ErrStopped)
+			}
+
+			Convey("and none of them are applied after a restart", func() {
+				So(ringMgr.Start(), ShouldBeNil)
+				So(ringMgr.Ping(), ShouldBeTrue)
+
+				snap, _ := ringMgr.Snapshot()
+				So(snap.Size(), ShouldEqual, 1)
+
+				ringMgr.Stop()
+			})
+		})
+	})
 }
 
 func Test_Commands(t *testing.T) {
@@ -63,6 +149,26 @@ func Test_Commands(t *testing.T) {
 			So(node, ShouldEqual, "njal")
 		})
 
+		Convey("AddWeightedNode adds a node and updates its weight", func() {
+			go ringMgr.Run(director.NewFreeLooper(103, nil))
+			// Make sure the RingManager is started
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			So(ringMgr.AddWeightedNode("njal", 0), ShouldNotBeNil)
+
+			So(ringMgr.AddWeightedNode("njal", 1), ShouldBeNil)
+			So(ringMgr.AddWeightedNode("njal", 20), ShouldBeNil)
+
+			counts := make(map[string]int)
+			for i := 0; i < 100; i++ {
+				node, err := ringMgr.GetNode(fmt.Sprintf("key-%d", i))
+				So(err, ShouldBeNil)
+				counts[node]++
+			}
+
+			So(counts["njal"], ShouldBeGreaterThan, counts["kjartan"]*3)
+		})
+
 		Convey("RemoveNode removes a node", func() {
 			go ringMgr.Run(director.NewFreeLooper(3, nil))
 			// Make sure the RingManager is started
@@ -75,6 +181,48 @@ func Test_Commands(t *testing.T) {
 			So(node, ShouldEqual, "")
 		})
 
+		Convey("GetNodes returns distinct nodes in ring order", func() {
+			go ringMgr.Run(director.NewFreeLooper(5, nil))
+			// Make sure the RingManager is started
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			ringMgr.AddNode("njal")
+			ringMgr.AddNode("gunnar")
+
+			nodes, err := ringMgr.GetNodes("foo", 2)
+			So(err, ShouldBeNil)
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0], ShouldEqual, "njal")
+			So(nodes[0], ShouldNotEqual, nodes[1])
+
+			Convey("and caps the count at the ring size", func() {
+				nodes, err := ringMgr.GetNodes("foo", 5)
+				So(err, ShouldBeNil)
+				So(len(nodes), ShouldEqual, 3)
+			})
+		})
+
+		Convey("GetNodes rejects a count below one", func() {
+			nodes, err := ringMgr.GetNodes("foo", 0)
+			So(err, ShouldNotBeNil)
+			So(nodes, ShouldBeNil)
+		})
+
+		Convey("lookups see the ring from before a change is applied", func() {
+			node, err := ringMgr.GetNode("foo")
+			So(err, ShouldBeNil)
+			So(node, ShouldEqual, "kjartan")
+
+			go ringMgr.Run(director.NewFreeLooper(2, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			So(ringMgr.AddNode("njal"), ShouldBeNil)
+
+			node, err = ringMgr.GetNode("foo")
+			So(err, ShouldBeNil)
+			So(node, ShouldEqual, "njal")
+		})
+
 		Convey("Ping responds as up, in a timely manner", func() {
 			go ringMgr.Run(director.NewFreeLooper(director.ONCE, nil))
 
@@ -93,6 +241,27 @@ func Test_Commands(t *testing.T) {
 			So(ringMgr.Ping(), ShouldBeFalse)
 		})
 
+		Convey("Ping gives up when the Run loop doesn't answer in time", func() {
+			go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			// Wedge the Run loop while it builds a placement
+			wedged := make(chan struct{})
+			release := make(chan struct{})
+			go ringMgr.SetPlacement(func(weights map[string]int) Placement {
+				close(wedged)
+				<-release
+				return NewHashringPlacement(weights)
+			})
+			<-wedged
+
+			start := time.Now()
+			So(ringMgr.Ping(), ShouldBeFalse)
+			So(time.Since(start), ShouldBeLessThan, StartTimeout/2)
+
+			close(release)
+		})
+
 		Convey("With error conditions", func() {
 			Convey("does not blow up on nil receiver", func() {
 				var broken *HashRingManager
@@ -107,6 +276,255 @@ func Test_Commands(t *testing.T) {
 				So(func() { broken.AddNode("junk") }, ShouldNotPanic)
 				So(func() { broken.RemoveNode("junk") }, ShouldNotPanic)
 			})
+
+			Convey("can be stopped and restarted if not initialized", func() {
+				broken := &HashRingManager{}
+
+				So(func() { broken.Stop() }, ShouldNotPanic)
+				So(broken.Restart(), ShouldEqual, ErrNotRunning)
+				So(broken.State(), ShouldEqual, ManagerIdle)
+
+				_, open := <-broken.Done()
+				So(open, ShouldBeFalse)
+
+				var nilMgr *HashRingManager
+				_, open = <-nilMgr.Done()
+				So(open, ShouldBeFalse)
+			})
+
+			Convey("lookups return an error if not initialized", func() {
+				broken := &HashRingManager{}
+
+				_, err := broken.GetNode("junk")
+				So(err, ShouldEqual, ErrNoRing)
+
+				_, err = broken.GetNodes("junk", 2)
+				So(err, ShouldEqual, ErrNoRing)
+			})
+		})
+	})
+}
+
+// benchRingManager returns a running HashRingManager with a ring of the size
+// we'd expect in a reasonable cluster.
+func benchRingManager(b *testing.B) (*HashRingManager, []string) {
+	var nodes []string
+	for i := 0; i < 20; i++ {
+		nodes = append(nodes, fmt.Sprintf("10.0.0.%d:8000", i))
+	}
+
+	ringMgr := NewHashRingManager(nodes)
+	go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+	if !ringMgr.Ping() {
+		b.Fatal("HashRingManager did not start")
+	}
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	return ringMgr, keys
+}
+
+func Benchmark_GetNode(b *testing.B) {
+	ringMgr, keys := benchRingManager(b)
+	defer ringMgr.Stop()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ringMgr.GetNode(keys[i%len(keys)])
+	}
+}
+
+func Benchmark_GetNodeParallel(b *testing.B) {
+	ringMgr, keys := benchRingManager(b)
+	defer ringMgr.Stop()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ringMgr.GetNode(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+func Benchmark_GetNodeParallelWithChanges(b *testing.B) {
+	ringMgr, keys := benchRingManager(b)
+	defer ringMgr.Stop()
+
+	// Keep the ring busy with membership changes while we look things up
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			ringMgr.AddNode("10.0.1.1:8000")
+			ringMgr.RemoveNode("10.0.1.1:8000")
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ringMgr.GetNode(keys[i%len(keys)])
+			i++
+		}
+	})
+	b.StopTimer()
+
+	close(quit)
+	<-done
+}
+
+func Test_Versions(t *testing.T) {
+	Convey("Ring versions", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal", "kjartan"})
+		ringMgr.Start()
+
+		So(ringMgr.Version(), ShouldEqual, 0)
+
+		Convey("come back with lookups", func() {
+			node, version, err := ringMgr.GetNodeWithVersion("foo")
+			So(err, ShouldBeNil)
+			So(node, ShouldEqual, "njal")
+			So(version, ShouldEqual, 0)
+
+			nodes, version, err := ringMgr.GetNodesWithVersion("foo", 2)
+			So(err, ShouldBeNil)
+			So(len(nodes), ShouldEqual, 2)
+			So(version, ShouldEqual, 0)
+		})
+
+		Convey("go up with each membership change", func() {
+			ringMgr.AddNode("gunnar")
+			So(ringMgr.Version(), ShouldEqual, 1)
+
+			ringMgr.RemoveNode("kjartan")
+			_, version, _ := ringMgr.GetNodeWithVersion("foo")
+			So(version, ShouldEqual, 2)
+		})
+
+		Convey("stay put when nothing changes", func() {
+			ringMgr.AddNode("njal")
+			ringMgr.RemoveNode("hallgerd")
+			So(ringMgr.Version(), ShouldEqual, 0)
+		})
+
+		Convey("handle a nil manager", func() {
+			var broken *HashRingManager
+			So(broken.Version(), ShouldEqual, 0)
+
+			_, _, err := broken.GetNodeWithVersion("foo")
+			So(err, ShouldEqual, ErrNilManager)
+			_, _, err = broken.GetNodesWithVersion("foo", 2)
+			So(err, ShouldEqual, ErrNilManager)
+		})
+
+		Reset(func() { ringMgr.Stop() })
+	})
+}
+
+func Test_ContextCommands(t *testing.T) {
+	Convey("Context variants of the commands", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal"})
+
+		Convey("give up when the Run loop isn't answering", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			So(ringMgr.AddNodeContext(ctx, "kjartan"), ShouldEqual, context.DeadlineExceeded)
+			So(ringMgr.PingContext(ctx), ShouldEqual, context.DeadlineExceeded)
+
+			Convey("and don't wedge it once it starts", func() {
+				go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+				So(ringMgr.PingContext(context.Background()), ShouldBeNil)
+
+				node, _ := ringMgr.GetNode("foo")
+				So(node, ShouldNotBeEmpty)
+
+				ringMgr.Stop()
+			})
+		})
+
+		Convey("give up when the command channel is full", func() {
+			for i := 0; i < CommandChannelLength; i++ {
+				ringMgr.cmdChan <- RingCommand{Command: CmdPing, ReplyChan: make(chan *RingReply, 1)}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			So(ringMgr.RemoveNodeContext(ctx, "njal"), ShouldEqual, context.DeadlineExceeded)
+		})
+
+		Convey("don't hang on a full channel before it is run", func() {
+			count := CommandChannelLength + 2
+			errs := make(chan error, count)
+			for i := 0; i < count; i++ {
+				go func(i int) { errs <- ringMgr.AddNode(fmt.Sprintf("node-%d", i)) }(i)
+			}
+
+			for i := 0; i < count; i++ {
+				select {
+				case err := <-errs:
+					So(err, ShouldEqual, ErrNotStarted)
+				case <-time.After(2 * StartTimeout):
+					So("sender stuck", ShouldBeEmpty)
+				}
+			}
+
+			So(ringMgr.State(), ShouldEqual, ManagerIdle)
+		})
+
+		Convey("return the context's error once it's done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			So(ringMgr.AddWeightedNodeContext(ctx, "kjartan", 2), ShouldEqual, context.Canceled)
+			So(ringMgr.SetPlacementContext(ctx, NewJumpPlacement), ShouldEqual, context.Canceled)
+
+			_, err := ringMgr.GetNodeContext(ctx, "foo")
+			So(err, ShouldEqual, context.Canceled)
+			_, err = ringMgr.GetNodesContext(ctx, "foo", 2)
+			So(err, ShouldEqual, context.Canceled)
+		})
+
+		Convey("apply changes when the Run loop is running", func() {
+			go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			So(ringMgr.PingContext(ctx), ShouldBeNil)
+			So(ringMgr.AddNodeWithLocationContext(ctx, "kjartan", 1, Location{Zone: "a"}), ShouldBeNil)
+			So(ringMgr.SetDrainingContext(ctx, "njal", true), ShouldBeNil)
+
+			node, err := ringMgr.GetNodeContext(ctx, "foo")
+			So(err, ShouldBeNil)
+			So(node, ShouldEqual, "kjartan")
+
+			ringMgr.Stop()
+		})
+
+		Convey("return typed errors when not running", func() {
+			ringMgr.Stop()
+			So(ringMgr.AddNodeContext(context.Background(), "kjartan"), ShouldEqual, ErrStopped)
+			So(ringMgr.PingContext(context.Background()), ShouldEqual, ErrStopped)
+
+			idle := &HashRingManager{}
+			So(idle.AddNodeContext(context.Background(), "kjartan"), ShouldEqual, ErrNotRunning)
+
+			var broken *HashRingManager
+			So(broken.AddNodeContext(context.Background(), "kjartan"), ShouldEqual, ErrNilManager)
 		})
 	})
 }
@@ -0,0 +1,232 @@
+package ringman
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	KubernetesSyncTimeout = 30 * time.Second // How long we wait for the first list of EndpointSlices
+)
+
+// A KubernetesRing is a ring backed by the EndpointSlices of a Kubernetes
+// Service. It watches them and keeps the ring in step, with a node for the
+// address and named port of each endpoint that is Ready. Endpoints that are
+// not ready, or are terminating, are left out. Our LocalNode is the
+// endpoint for the pod we run in, and is "" while the pod is not ready.
+type KubernetesRing struct {
+	managedRing
+	namespace  string
+	svcName    string
+	portName   string
+	lister     discoverylisters.EndpointSliceLister
+	selector   labels.Selector
+	factory    informers.SharedInformerFactory
+	stopChan   chan struct{}
+	updateLock sync.Mutex // Serializes onUpdate
+	hostname   string     // Our own pod name, read under updateLock
+}
+
+// Ensure KubernetesRing implements Ring interface
+var _ Ring = (*KubernetesRing)(nil)
+
+// NewInClusterKubernetesRing returns a KubernetesRing configured like
+// NewKubernetesRing does, using the service account of the pod it runs in.
+func NewInClusterKubernetesRing(namespace string, svcName string, portName string) (*KubernetesRing, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKubernetesRing(client, namespace, svcName, portName)
+}
+
+// NewKubernetesRing returns a running KubernetesRing for the endpoints of the
+// Service in the namespace, on the port with the name provided. portName may
+// be empty if the Service's port is not named. It waits until the current
+// EndpointSlices have been listed, so the ring is ready to use.
+func NewKubernetesRing(client kubernetes.Interface, namespace string, svcName string,
+	portName string) (*KubernetesRing, error) {
+
+	// Pods are named after their hostname
+	hostname, _ := os.Hostname()
+
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svcName})
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector.String()
+		}),
+	)
+	informer := factory.Discovery().V1().EndpointSlices()
+
+	k8sRing := &KubernetesRing{
+		namespace: namespace,
+		svcName:   svcName,
+		portName:  portName,
+		lister:    informer.Lister(),
+		selector:  selector,
+		factory:   factory,
+		stopChan:  make(chan struct{}),
+		hostname:  hostname,
+	}
+	k8sRing.startManager()
+
+	// Whatever changed, we rebuild from all of the Service's slices
+	_, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { k8sRing.onUpdate() },
+		UpdateFunc: func(oldObj, newObj interface{}) { k8sRing.onUpdate() },
+		DeleteFunc: func(obj interface{}) { k8sRing.onUpdate() },
+	})
+	if err != nil {
+		k8sRing.Shutdown()
+		return nil, err
+	}
+
+	factory.Start(k8sRing.stopChan)
+
+	syncStop := make(chan struct{})
+	timeout := time.AfterFunc(KubernetesSyncTimeout, func() { close(syncStop) })
+	synced := factory.WaitForCacheSync(syncStop)
+	timeout.Stop()
+
+	for _, ok := range synced {
+		if !ok {
+			k8sRing.Shutdown()
+			return nil, errors.New("Unable to list EndpointSlices for " + namespace + "/" + svcName)
+		}
+	}
+
+	// The handlers may not have seen everything yet
+	k8sRing.onUpdate()
+
+	return k8sRing, nil
+}
+
+// onUpdate replaces the membership of the ring with the Ready endpoints in
+// all of the Service's EndpointSlices. Our own node is the endpoint for the
+// pod we're running in.
+func (r *KubernetesRing) onUpdate() {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+
+	slices, err := r.lister.EndpointSlices(r.namespace).List(r.selector)
+	if err != nil {
+		r.logger.get().Error("Unable to list EndpointSlices", "service", r.svcName, "error", err)
+		return
+	}
+
+	var localNode string
+	var infos []Node
+	seen := make(map[string]bool)
+
+	for _, slice := range slices {
+		port, ok := r.portForSlice(slice)
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if !endpointReady(endpoint) || len(endpoint.Addresses) == 0 {
+				continue
+			}
+
+			// The same endpoint can briefly show up in two slices
+			info := r.nodeForEndpoint(endpoint, port)
+			if seen[info.ID] {
+				continue
+			}
+			seen[info.ID] = true
+			infos = append(infos, info)
+
+			if info.Name == r.hostname {
+				localNode = info.ID
+			}
+		}
+	}
+
+	// Replace the whole set at once, so the ring is only rebuilt once
+	err = r.manager.SetNodesInfo(infos)
+	if err != nil {
+		r.logger.get().Error("Unable to update ring from Kubernetes", "service", r.svcName, "error", err)
+		return
+	}
+
+	r.setLocalNode(localNode)
+}
+
+// portForSlice returns the number of our named port in the slice.
+func (r *KubernetesRing) portForSlice(slice *discoveryv1.EndpointSlice) (int32, bool) {
+	for _, port := range slice.Ports {
+		name := ""
+		if port.Name != nil {
+			name = *port.Name
+		}
+
+		if name == r.portName && port.Port != nil {
+			return *port.Port, true
+		}
+	}
+
+	return 0, false
+}
+
+// endpointReady returns true if the endpoint should be in the ring. An
+// unknown readiness counts as ready, as the EndpointSlice API asks.
+func endpointReady(endpoint discoveryv1.Endpoint) bool {
+	if endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating {
+		return false
+	}
+
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// nodeForEndpoint returns the Node for an endpoint. Its ID is the endpoint's
+// first address and the port.
+func (r *KubernetesRing) nodeForEndpoint(endpoint discoveryv1.Endpoint, port int32) Node {
+	info := nodeFromID(net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(int(port))))
+	info.Metadata = map[string]string{"service": r.svcName, "namespace": r.namespace}
+
+	if endpoint.TargetRef != nil && endpoint.TargetRef.Name != "" {
+		info.Name = endpoint.TargetRef.Name
+	}
+
+	if endpoint.Zone != nil {
+		info.Location.Zone = *endpoint.Zone
+	}
+
+	if endpoint.NodeName != nil {
+		info.Metadata["node"] = *endpoint.NodeName
+	}
+
+	return info
+}
+
+// Shutdown stops watching the EndpointSlices and stops the HashRingManager.
+func (r *KubernetesRing) Shutdown() {
+	r.shutdown(func() {
+		close(r.stopChan)
+		r.factory.Shutdown()
+
+		r.stopManager()
+	})
+}
@@ -0,0 +1,146 @@
+package ringman
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// endpointSlice returns an EndpointSlice for the service with one named port
+func endpointSlice(name string, svcName string, portName string, port int32,
+	endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: svcName},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+		Endpoints:   endpoints,
+	}
+}
+
+// podEndpoint returns an Endpoint for the pod
+func podEndpoint(address string, pod string, ready bool, terminating bool) discoveryv1.Endpoint {
+	zone := "us-east-1a"
+	nodeName := "worker-1"
+
+	return discoveryv1.Endpoint{
+		Addresses:  []string{address},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready, Terminating: &terminating},
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod, Namespace: "default"},
+		Zone:       &zone,
+		NodeName:   &nodeName,
+	}
+}
+
+func Test_KubernetesRing(t *testing.T) {
+	Convey("KubernetesRing", t, func() {
+		ctx := context.Background()
+
+		client := fake.NewClientset(
+			endpointSlice("ringman-abc", "ringman", "http", 8000,
+				podEndpoint("10.0.0.1", "ringman-1", true, false),
+				podEndpoint("10.0.0.2", "ringman-2", true, false),
+				podEndpoint("10.0.0.3", "ringman-3", false, false),
+			),
+			endpointSlice("other-abc", "other", "http", 8000,
+				podEndpoint("10.0.1.1", "other-1", true, false),
+			),
+		)
+		slices := client.DiscoveryV1().EndpointSlices("default")
+
+		ring, err := NewKubernetesRing(client, "default", "ringman", "http")
+		So(err, ShouldBeNil)
+
+		Convey("adds only the Ready endpoints of the service", func() {
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+			So(nodes[0].Name, ShouldEqual, "ringman-1")
+			So(nodes[0].Address, ShouldEqual, "10.0.0.1")
+			So(nodes[0].Port, ShouldEqual, 8000)
+			So(nodes[0].Location.Zone, ShouldEqual, "us-east-1a")
+			So(nodes[0].Metadata["node"], ShouldEqual, "worker-1")
+			So(nodes[1].ID, ShouldEqual, "10.0.0.2:8000")
+		})
+
+		Convey("adds endpoints when they become Ready", func() {
+			_, err := slices.Update(ctx, endpointSlice("ringman-abc", "ringman", "http", 8000,
+				podEndpoint("10.0.0.1", "ringman-1", true, false),
+				podEndpoint("10.0.0.2", "ringman-2", true, false),
+				podEndpoint("10.0.0.3", "ringman-3", true, false),
+			), metav1.UpdateOptions{})
+			So(err, ShouldBeNil)
+
+			nodes := waitForNodes(ring, 3)
+			So(len(nodes), ShouldEqual, 3)
+			So(nodes[2].ID, ShouldEqual, "10.0.0.3:8000")
+		})
+
+		Convey("removes endpoints that are terminating", func() {
+			_, err := slices.Update(ctx, endpointSlice("ringman-abc", "ringman", "http", 8000,
+				podEndpoint("10.0.0.1", "ringman-1", true, false),
+				podEndpoint("10.0.0.2", "ringman-2", true, true),
+			), metav1.UpdateOptions{})
+			So(err, ShouldBeNil)
+
+			nodes := waitForNodes(ring, 1)
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+		})
+
+		Convey("follows slices as they are added and deleted", func() {
+			_, err := slices.Create(ctx, endpointSlice("ringman-def", "ringman", "http", 8000,
+				podEndpoint("10.0.0.4", "ringman-4", true, false),
+			), metav1.CreateOptions{})
+			So(err, ShouldBeNil)
+			So(len(waitForNodes(ring, 3)), ShouldEqual, 3)
+
+			So(slices.Delete(ctx, "ringman-abc", metav1.DeleteOptions{}), ShouldBeNil)
+
+			nodes := waitForNodes(ring, 1)
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.4:8000")
+		})
+
+		Convey("only uses the named port", func() {
+			other, err := NewKubernetesRing(client, "default", "ringman", "grpc")
+			So(err, ShouldBeNil)
+			defer other.Shutdown()
+
+			nodes, _ := other.Manager().ListNodes()
+			So(nodes, ShouldBeEmpty)
+		})
+
+		Convey("finds its local node from the pod name", func() {
+			So(ring.LocalNode(), ShouldEqual, "")
+
+			ring.updateLock.Lock()
+			ring.hostname = "ringman-2"
+			ring.updateLock.Unlock()
+
+			ring.onUpdate()
+			So(ring.LocalNode(), ShouldEqual, "10.0.0.2:8000")
+
+			owner, _ := ring.Manager().GetNode("bocaccio")
+			So(ring.IsLocal("bocaccio"), ShouldEqual, owner == "10.0.0.2:8000")
+		})
+
+		Convey("can be shut down more than once", func() {
+			ring.Shutdown()
+			So(func() { ring.Shutdown() }, ShouldNotPanic)
+		})
+
+		Reset(func() {
+			ring.Shutdown()
+		})
+	})
+}
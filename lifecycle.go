@@ -0,0 +1,208 @@
+package ringman
+
+import (
+	"errors"
+
+	"github.com/relistan/go-director"
+)
+
+// ManagerState is where a HashRingManager is in its lifecycle.
+type ManagerState int
+
+const (
+	ManagerIdle     ManagerState = iota // Created, but never run
+	ManagerRunning  ManagerState = iota
+	ManagerStopping ManagerState = iota // Stop was called, but Run hasn't returned
+	ManagerStopped  ManagerState = iota
+)
+
+func (s ManagerState) String() string {
+	switch s {
+	case ManagerIdle:
+		return "Idle"
+	case ManagerRunning:
+		return "Running"
+	case ManagerStopping:
+		return "Stopping"
+	case ManagerStopped:
+		return "Stopped"
+	default:
+		return "Unknown"
+	}
+}
+
+// State returns where the HashRingManager is in its lifecycle.
+func (r *HashRingManager) State() ManagerState {
+	if r == nil {
+		return ManagerStopped
+	}
+
+	r.lifecycle.RLock()
+	defer r.lifecycle.RUnlock()
+
+	return r.state
+}
+
+// neverRuns is the Done channel for a HashRingManager that can never run,
+// e.g. a nil one or one that wasn't made with NewHashRingManager.
+var neverRuns = func() chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}()
+
+// Done returns a channel that is closed when the HashRingManager stops. Each
+// restart gets a new channel, so call Done again after restarting. For a
+// manager that can never run, the channel is already closed.
+func (r *HashRingManager) Done() <-chan struct{} {
+	if r == nil {
+		return neverRuns
+	}
+
+	r.lifecycle.RLock()
+	defer r.lifecycle.RUnlock()
+
+	if r.done == nil {
+		return neverRuns
+	}
+
+	return r.done
+}
+
+// Start runs the HashRingManager in the background until it is stopped. It
+// is equivalent to calling Run with a looper that runs forever, but it
+// returns once the manager is running, so commands can be sent right away.
+func (r *HashRingManager) Start() error {
+	if r == nil {
+		return ErrNilManager
+	}
+
+	quit, exited, err := r.begin()
+	if err != nil {
+		return err
+	}
+
+	go r.loop(director.NewFreeLooper(director.FOREVER, nil), quit, exited)
+
+	return nil
+}
+
+// Stop the HashRingManager from running. Commands sent after this return
+// ErrStopped, as do any left waiting in the command channel. The ring itself
+// is kept, and lookups keep working against it. Stopping a manager that isn't
+// running does nothing.
+func (r *HashRingManager) Stop() {
+	// One that wasn't initialized can't have been running
+	if r == nil || r.cmdChan == nil {
+		return
+	}
+
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+
+	switch r.state {
+	case ManagerRunning:
+		r.state = ManagerStopping
+		close(r.quit)
+	case ManagerIdle:
+		// Nothing is running to clean up after us
+		r.state = ManagerStopped
+		r.rejectPending()
+		close(r.started)
+		close(r.done)
+	}
+}
+
+// Restart stops the HashRingManager if it is running, waits for it to stop,
+// and starts it again. The ring is the same as it was before.
+func (r *HashRingManager) Restart() error {
+	if r == nil {
+		return ErrNilManager
+	}
+
+	r.Stop()
+	<-r.Done()
+
+	return r.Start()
+}
+
+// begin moves the manager into the running state and returns the channel
+// that will be closed to stop it, and the one the Run loop closes on exit.
+func (r *HashRingManager) begin() (chan struct{}, chan struct{}, error) {
+	if r.cmdChan == nil {
+		return nil, nil, ErrNotRunning
+	}
+
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+
+	switch r.state {
+	case ManagerRunning:
+		return nil, nil, errors.New("HashRingManager is already running")
+	case ManagerStopping:
+		return nil, nil, errors.New("HashRingManager is still stopping")
+	case ManagerIdle:
+		close(r.started)
+	case ManagerStopped:
+		r.done = make(chan struct{})
+	}
+
+	r.state = ManagerRunning
+	r.quit = make(chan struct{})
+	r.exited = make(chan struct{})
+
+	return r.quit, r.exited, nil
+}
+
+// finish moves the manager into the stopped state once the Run loop has
+// exited, whether it was stopped or the looper ran out.
+func (r *HashRingManager) finish() {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+
+	r.state = ManagerStopped
+	r.rejectPending()
+	close(r.done)
+}
+
+// rejectPending answers every command left in the command channel with
+// ErrStopped. It must be called with the lifecycle lock held, so that the
+// state can't change underneath it.
+func (r *HashRingManager) rejectPending() {
+	for {
+		select {
+		case msg := <-r.cmdChan:
+			msg.reject()
+		default:
+			return
+		}
+	}
+}
+
+// isStale reports whether the command was sent to a run of the manager that
+// has since ended. Its sender has already been given an error.
+func (cmd *RingCommand) isStale() bool {
+	if cmd.run == nil {
+		return false
+	}
+
+	select {
+	case <-cmd.run:
+		return true
+	default:
+		return false
+	}
+}
+
+// reject answers the command with ErrStopped.
+func (cmd *RingCommand) reject() {
+	if cmd.ReplyChan == nil {
+		return
+	}
+
+	select {
+	case cmd.ReplyChan <- &RingReply{Error: ErrStopped}:
+	default:
+		// Nobody is listening any more
+	}
+}
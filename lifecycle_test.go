@@ -0,0 +1,233 @@
+package ringman
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// gatedLooper holds off running its Looper until the gate is closed
+type gatedLooper struct {
+	director.Looper
+	gate chan struct{}
+}
+
+func (l *gatedLooper) Loop(fn func() error) {
+	<-l.gate
+	l.Looper.Loop(fn)
+}
+
+func Test_Lifecycle(t *testing.T) {
+	Convey("HashRingManager lifecycle", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal"})
+
+		Convey("starts out idle", func() {
+			So(ringMgr.State(), ShouldEqual, ManagerIdle)
+			So(ringMgr.State().String(), ShouldEqual, "Idle")
+		})
+
+		Convey("can be started and stopped", func() {
+			So(ringMgr.Start(), ShouldBeNil)
+			So(ringMgr.State(), ShouldEqual, ManagerRunning)
+			So(ringMgr.Start(), ShouldNotBeNil)
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			ringMgr.Stop()
+			<-ringMgr.Done()
+			So(ringMgr.State(), ShouldEqual, ManagerStopped)
+		})
+
+		Convey("rejects commands while stopped", func() {
+			ringMgr.Start()
+			ringMgr.Stop()
+
+			So(ringMgr.AddNode("kjartan"), ShouldEqual, ErrStopped)
+			So(ringMgr.RemoveNode("njal"), ShouldEqual, ErrStopped)
+			So(ringMgr.Ping(), ShouldBeFalse)
+
+			Convey("but still serves lookups", func() {
+				node, err := ringMgr.GetNode("foo")
+				So(err, ShouldBeNil)
+				So(node, ShouldEqual, "njal")
+			})
+		})
+
+		Convey("rejects commands queued before it was stopped", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			result := make(chan error, 1)
+			go func() { result <- ringMgr.AddNodeContext(ctx, "kjartan") }()
+
+			// Wait for the command to be queued
+			for ringMgr.Pending() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			ringMgr.Stop()
+			So(<-result, ShouldEqual, ErrStopped)
+		})
+
+		Convey("keeps the ring across a restart", func() {
+			ringMgr.Start()
+			ringMgr.AddWeightedNode("kjartan", 3)
+			before, _ := ringMgr.Snapshot()
+
+			done := ringMgr.Done()
+			So(ringMgr.Restart(), ShouldBeNil)
+
+			// The old run is over, and the new one has its own channel
+			So(isClosed(done), ShouldBeTrue)
+			So(isClosed(ringMgr.Done()), ShouldBeFalse)
+			So(ringMgr.State(), ShouldEqual, ManagerRunning)
+
+			after, _ := ringMgr.Snapshot()
+			So(after.Version, ShouldEqual, before.Version)
+			So(after.Weights(), ShouldResemble, before.Weights())
+
+			So(ringMgr.AddNode("gunnar"), ShouldBeNil)
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Version, ShouldEqual, before.Version+1)
+
+			ringMgr.Stop()
+		})
+
+		Convey("can be run again with Run after stopping", func() {
+			go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			ringMgr.Stop()
+			<-ringMgr.Done()
+
+			// Commands are rejected until Run has actually begun
+			go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+			for ringMgr.State() != ManagerRunning {
+				time.Sleep(time.Millisecond)
+			}
+
+			So(ringMgr.Ping(), ShouldBeTrue)
+			So(ringMgr.AddNode("kjartan"), ShouldBeNil)
+
+			ringMgr.Stop()
+		})
+
+		Convey("stops when the looper runs out", func() {
+			go ringMgr.Run(director.NewFreeLooper(director.ONCE, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			<-ringMgr.Done()
+			So(ringMgr.State(), ShouldEqual, ManagerStopped)
+			So(ringMgr.AddNode("kjartan"), ShouldEqual, ErrStopped)
+		})
+
+		Convey("doesn't leave senders stuck when the looper runs out on a full channel", func() {
+			looper := &gatedLooper{Looper: director.NewFreeLooper(director.ONCE, nil), gate: make(chan struct{})}
+			go ringMgr.Run(looper)
+			for ringMgr.State() != ManagerRunning {
+				time.Sleep(time.Millisecond)
+			}
+
+			for i := 0; i < CommandChannelLength; i++ {
+				ringMgr.cmdChan <- RingCommand{Command: CmdPing, ReplyChan: make(chan *RingReply, 1)}
+			}
+
+			// The looper takes one, which leaves one of these still waiting
+			errs := make(chan error, 2)
+			go func() { errs <- ringMgr.AddNode("kjartan") }()
+			go func() { errs <- ringMgr.AddNode("gunnar") }()
+			time.Sleep(10 * time.Millisecond)
+			close(looper.gate)
+
+			for i := 0; i < 2; i++ {
+				select {
+				case err := <-errs:
+					So(err, ShouldEqual, ErrStopped)
+				case <-time.After(time.Second):
+					So("sender stuck", ShouldBeEmpty)
+				}
+			}
+
+			<-ringMgr.Done()
+			So(ringMgr.State(), ShouldEqual, ManagerStopped)
+		})
+
+		Convey("is safe to stop while commands are in flight", func() {
+			ringMgr.Start()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						err := ringMgr.AddNode(fmt.Sprintf("node-%d-%d", i, j))
+						if err == ErrStopped {
+							return
+						}
+						ringMgr.GetNode("foo")
+					}
+				}(i)
+			}
+
+			time.Sleep(time.Millisecond)
+			ringMgr.Stop()
+			wg.Wait()
+			<-ringMgr.Done()
+
+			So(ringMgr.State(), ShouldEqual, ManagerStopped)
+		})
+
+		Convey("doesn't wait forever for it to be run", func() {
+			So(ringMgr.AddNode("kjartan"), ShouldEqual, ErrNotStarted)
+
+			// The change was queued, so is applied once it starts
+			So(ringMgr.Start(), ShouldBeNil)
+			So(ringMgr.Ping(), ShouldBeTrue)
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Weights(), ShouldContainKey, "kjartan")
+			ringMgr.Stop()
+		})
+
+		Convey("waits for it to be run if it starts in time", func() {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				ringMgr.Start()
+			}()
+
+			So(ringMgr.AddNode("kjartan"), ShouldBeNil)
+			ringMgr.Stop()
+		})
+
+		Convey("handles being stopped before it starts", func() {
+			ringMgr.Stop()
+			So(isClosed(ringMgr.Done()), ShouldBeTrue)
+			So(ringMgr.AddNode("kjartan"), ShouldEqual, ErrStopped)
+
+			So(ringMgr.Start(), ShouldBeNil)
+			So(ringMgr.AddNode("kjartan"), ShouldBeNil)
+			ringMgr.Stop()
+		})
+
+		Convey("handles a nil receiver", func() {
+			var broken *HashRingManager
+			So(broken.Start(), ShouldEqual, ErrNilManager)
+			So(broken.Restart(), ShouldEqual, ErrNilManager)
+			So(broken.State(), ShouldEqual, ManagerStopped)
+			So(func() { broken.Stop() }, ShouldNotPanic)
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package ringman
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A Logger receives the log output of ringman. Each message comes with
+// structured fields as alternating keys and values, e.g. "node", "10.0.0.1:8000",
+// the same way log/slog takes them. A *slog.Logger satisfies this interface
+// as it is, and NewLogrusLogger adapts logrus.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+var defaultLogger atomic.Value // Always holds a loggerBox
+
+func init() {
+	defaultLogger.Store(loggerBox{NewLogrusLogger(logrus.StandardLogger())})
+}
+
+// SetDefaultLogger replaces the Logger used by everything that hasn't been
+// given one of its own. It starts out as the global logrus logger.
+func SetDefaultLogger(logger Logger) {
+	if logger == nil {
+		logger = NewLogrusLogger(logrus.StandardLogger())
+	}
+
+	defaultLogger.Store(loggerBox{logger})
+}
+
+// loggerBox lets us keep an interface in an atomic.Value, which insists on
+// always storing the same concrete type.
+type loggerBox struct {
+	Logger
+}
+
+// loggerRef holds a Logger that may be replaced while it's in use. Until one
+// is set, it returns the default logger.
+type loggerRef struct {
+	value atomic.Value // Holds a loggerBox once set
+}
+
+func (l *loggerRef) set(logger Logger) {
+	l.value.Store(loggerBox{logger})
+}
+
+func (l *loggerRef) get() Logger {
+	if box, ok := l.value.Load().(loggerBox); ok && box.Logger != nil {
+		return box.Logger
+	}
+
+	return defaultLogger.Load().(loggerBox).Logger
+}
+
+// NewSlogLogger returns a Logger that writes to the slog.Logger provided, or
+// to slog.Default() if it is nil.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &slogLogger{logger: logger}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (s *slogLogger) Debug(msg string, fields ...interface{}) { s.logger.Debug(msg, fields...) }
+func (s *slogLogger) Info(msg string, fields ...interface{})  { s.logger.Info(msg, fields...) }
+func (s *slogLogger) Warn(msg string, fields ...interface{})  { s.logger.Warn(msg, fields...) }
+func (s *slogLogger) Error(msg string, fields ...interface{}) { s.logger.Error(msg, fields...) }
+
+// NewLogrusLogger returns a Logger that writes to the logrus logger or entry
+// provided, turning the fields into logrus.Fields.
+func NewLogrusLogger(logger logrus.FieldLogger) Logger {
+	return &logrusLogger{logger: logger}
+}
+
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+func (l *logrusLogger) Debug(msg string, fields ...interface{}) {
+	l.withFields(fields).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, fields ...interface{}) {
+	l.withFields(fields).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, fields ...interface{}) {
+	l.withFields(fields).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, fields ...interface{}) {
+	l.withFields(fields).Error(msg)
+}
+
+// withFields pairs up the keys and values. A value without a key is logged
+// under "!BADKEY", like slog does.
+func (l *logrusLogger) withFields(fields []interface{}) logrus.FieldLogger {
+	if len(fields) == 0 {
+		return l.logger
+	}
+
+	logrusFields := make(logrus.Fields, (len(fields)+1)/2)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			logrusFields["!BADKEY"] = fields[i]
+			break
+		}
+
+		logrusFields[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+
+	return l.logger.WithFields(logrusFields)
+}
@@ -0,0 +1,186 @@
+package ringman
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/relistan/go-director"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type loggedMessage struct {
+	Level   string
+	Message string
+	Fields  map[string]interface{}
+}
+
+// recordingLogger is a Logger that keeps everything it is sent
+type recordingLogger struct {
+	sync.Mutex
+	messages []loggedMessage
+}
+
+func (l *recordingLogger) record(level string, msg string, fields []interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	logged := loggedMessage{Level: level, Message: msg, Fields: make(map[string]interface{})}
+	for i := 0; i+1 < len(fields); i += 2 {
+		logged.Fields[fields[i].(string)] = fields[i+1]
+	}
+
+	l.messages = append(l.messages, logged)
+}
+
+func (l *recordingLogger) find(msg string) *loggedMessage {
+	l.Lock()
+	defer l.Unlock()
+
+	for i := range l.messages {
+		if l.messages[i].Message == msg {
+			return &l.messages[i]
+		}
+	}
+
+	return nil
+}
+
+func (l *recordingLogger) Debug(msg string, fields ...interface{}) { l.record("debug", msg, fields) }
+func (l *recordingLogger) Info(msg string, fields ...interface{})  { l.record("info", msg, fields) }
+func (l *recordingLogger) Warn(msg string, fields ...interface{})  { l.record("warn", msg, fields) }
+func (l *recordingLogger) Error(msg string, fields ...interface{}) { l.record("error", msg, fields) }
+
+func Test_SlogLogger(t *testing.T) {
+	Convey("NewSlogLogger()", t, func() {
+		var buf bytes.Buffer
+		logger := NewSlogLogger(
+			slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		)
+
+		Convey("writes the message and fields to slog", func() {
+			logger.Warn("Adding node", "node", "10.0.0.1:8000", "version", uint64(3))
+
+			var line map[string]interface{}
+			So(json.Unmarshal(buf.Bytes(), &line), ShouldBeNil)
+			So(line["level"], ShouldEqual, "WARN")
+			So(line["msg"], ShouldEqual, "Adding node")
+			So(line["node"], ShouldEqual, "10.0.0.1:8000")
+			So(line["version"], ShouldEqual, 3)
+		})
+
+		Convey("uses the default slog logger when given nil", func() {
+			So(NewSlogLogger(nil).(*slogLogger).logger, ShouldEqual, slog.Default())
+		})
+	})
+}
+
+func Test_LogrusLogger(t *testing.T) {
+	Convey("NewLogrusLogger()", t, func() {
+		var buf bytes.Buffer
+		logrusLogger := logrus.New()
+		logrusLogger.Out = &buf
+		logrusLogger.Formatter = &logrus.JSONFormatter{}
+		logrusLogger.Level = logrus.DebugLevel
+
+		logger := NewLogrusLogger(logrusLogger)
+
+		Convey("writes the message and fields to logrus", func() {
+			logger.Error("Removing node", "node", "10.0.0.1:8000", "key", "bocaccio")
+
+			var line map[string]interface{}
+			So(json.Unmarshal(buf.Bytes(), &line), ShouldBeNil)
+			So(line["level"], ShouldEqual, "error")
+			So(line["msg"], ShouldEqual, "Removing node")
+			So(line["node"], ShouldEqual, "10.0.0.1:8000")
+			So(line["key"], ShouldEqual, "bocaccio")
+		})
+
+		Convey("logs a value without a key under !BADKEY", func() {
+			logger.Info("Odd fields", "node", "10.0.0.1:8000", "dangling")
+
+			var line map[string]interface{}
+			So(json.Unmarshal(buf.Bytes(), &line), ShouldBeNil)
+			So(line["node"], ShouldEqual, "10.0.0.1:8000")
+			So(line["!BADKEY"], ShouldEqual, "dangling")
+		})
+
+		Convey("respects the logrus level", func() {
+			logrusLogger.Level = logrus.InfoLevel
+			logger.Debug("Hidden")
+
+			So(buf.Len(), ShouldEqual, 0)
+		})
+	})
+}
+
+func Test_SetLogger(t *testing.T) {
+	Convey("SetLogger()", t, func() {
+		logger := &recordingLogger{}
+
+		Convey("routes HashRingManager output to the Logger", func() {
+			ringMgr := NewHashRingManager([]string{})
+			ringMgr.SetLogger(logger)
+			go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+
+			So(ringMgr.AddNode("10.0.0.1:8000"), ShouldBeNil)
+
+			msg := logger.find("Adding node")
+			So(msg, ShouldNotBeNil)
+			So(msg.Level, ShouldEqual, "debug")
+			So(msg.Fields["node"], ShouldEqual, "10.0.0.1:8000")
+
+			msg = logger.find("Published new ring")
+			So(msg, ShouldNotBeNil)
+			So(msg.Fields["version"], ShouldEqual, uint64(1))
+
+			ringMgr.Stop()
+			<-ringMgr.Done()
+		})
+
+		Convey("routes Delegate output to the Logger", func() {
+			delegate := NewDelegate(nil, &NodeMetadata{ServicePort: "8000"})
+			delegate.SetLogger(logger)
+
+			delegate.NotifyLeave(testNode(1, false))
+
+			msg := logger.find("Ring manager was nil in delegate!")
+			So(msg, ShouldNotBeNil)
+			So(msg.Level, ShouldEqual, "error")
+		})
+
+		Convey("routes LoggingBridge output to the Logger", func() {
+			bridge := &LoggingBridge{}
+			bridge.SetLogger(logger)
+
+			bridge.Write([]byte("2016/06/24 11:45:33 [WARN] memberlist: Something something\n"))
+
+			msg := logger.find("memberlist: Something something")
+			So(msg, ShouldNotBeNil)
+			So(msg.Level, ShouldEqual, "warn")
+		})
+
+		Convey("falls back to the default Logger when given nil", func() {
+			fallback := &recordingLogger{}
+			SetDefaultLogger(fallback)
+
+			ringMgr := NewHashRingManager([]string{})
+			ringMgr.SetLogger(logger)
+			ringMgr.SetLogger(nil)
+			ringMgr.logger.get().Info("Hello")
+
+			So(fallback.find("Hello"), ShouldNotBeNil)
+			So(logger.find("Hello"), ShouldBeNil)
+
+			SetDefaultLogger(nil)
+		})
+
+		Convey("is safe to call on a nil HashRingManager", func() {
+			var ringMgr *HashRingManager
+			So(func() { ringMgr.SetLogger(logger) }, ShouldNotPanic)
+		})
+	})
+}
@@ -5,52 +5,151 @@ package ringman
 
 import (
 	"bytes"
+	"sync"
+)
 
-	log "github.com/sirupsen/logrus"
+const (
+	// MaxLogLineLength is the longest line the LoggingBridge will buffer
+	// while waiting for its newline. Anything longer is logged in pieces.
+	MaxLogLineLength = 64 * 1024
 )
 
 // This is a bridge to take the output of Memberlist, which uses a standard
-// Go logger and reformat them into properly leveled logrus lines. If
+// Go logger and reformat them into properly leveled lines on our Logger. If
 // only the stdlib log.Logger were an interface and not a type...
 
 type LoggingBridge struct {
 	testing     bool
 	lastLevel   []byte
 	lastMessage []byte
+	logger      loggerRef
+
+	lock    sync.Mutex
+	pending []byte // A partial line, waiting for the rest of it
+}
+
+// SetLogger sets the Logger the bridge writes to. Until it is called, the
+// default Logger is used.
+func (l *LoggingBridge) SetLogger(logger Logger) {
+	l.logger.set(logger)
 }
 
 // Memberlist log lines look like:
 // 2016/06/24 11:45:33 [DEBUG] memberlist: TCP connection from=172.16.106.1:59598
+//
+// But the prefix depends on the flags of the log.Logger, so we don't count
+// on it. The level is the first known one in square brackets, and the
+// message is everything after it.
 
-// Processes one line at a time from the input. If we somehow
-// get less than one line in the input, then weird things will
-// happen. Experience shows this doesn't currently happen.
+// logLevels maps the levels Memberlist and friends use to our Logger
+var logLevels = map[string]func(Logger, string){
+	"[TRACE]":   func(l Logger, msg string) { l.Debug(msg) },
+	"[DEBUG]":   func(l Logger, msg string) { l.Debug(msg) },
+	"[INFO]":    func(l Logger, msg string) { l.Info(msg) },
+	"[WARN]":    func(l Logger, msg string) { l.Warn(msg) },
+	"[WARNING]": func(l Logger, msg string) { l.Warn(msg) },
+	"[ERR]":     func(l Logger, msg string) { l.Error(msg) },
+	"[ERROR]":   func(l Logger, msg string) { l.Error(msg) },
+}
+
+// Write logs each complete line in data. A trailing partial line is kept
+// until the rest of it arrives in a later Write, or Flush is called. It
+// always consumes all of data.
 func (l *LoggingBridge) Write(data []byte) (int, error) {
-	lines := bytes.Split(data, []byte{byte('\n')})
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.pending = append(l.pending, data...)
+
+	for {
+		idx := bytes.IndexByte(l.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		l.logPieces(l.pending[:idx])
+		l.pending = l.pending[idx+1:]
+	}
+
+	for len(l.pending) > MaxLogLineLength {
+		l.logLine(l.pending[:MaxLogLineLength])
+		l.pending = l.pending[MaxLogLineLength:]
+	}
+
+	// Don't hold on to the whole buffer for the sake of a partial line
+	l.pending = append([]byte(nil), l.pending...)
+
+	return len(data), nil
+}
 
-	bytesWritten := len(lines[0])
+// Flush logs any partial line still waiting for its newline.
+func (l *LoggingBridge) Flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 
-	fields := bytes.Split(lines[0], []byte{byte(' ')})
-	l.logMessageAtLevel(bytes.Join(fields[3:], []byte{byte(' ')}), fields[2])
+	l.logLine(l.pending)
+	l.pending = nil
+}
+
+// logPieces logs a complete line, in pieces of MaxLogLineLength if it is
+// longer than that, just as if it had arrived a bit at a time.
+func (l *LoggingBridge) logPieces(line []byte) {
+	for len(line) > MaxLogLineLength {
+		l.logLine(line[:MaxLogLineLength])
+		line = line[MaxLogLineLength:]
+	}
+
+	l.logLine(line)
+}
+
+// logLine splits the level from the line and logs the message at that level.
+// Lines with no level we know are logged whole, at Info.
+func (l *LoggingBridge) logLine(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
 
-	return bytesWritten, nil
+	level, message := splitLevel(line)
+	l.logMessageAtLevel(message, level)
+}
+
+// splitLevel finds the first known level in the line and returns it, along
+// with the message that follows it. If there isn't one, the level is nil
+// and the message is the whole line.
+func splitLevel(line []byte) ([]byte, []byte) {
+	rest := line
+	for {
+		start := bytes.IndexByte(rest, '[')
+		if start < 0 {
+			return nil, bytes.TrimSpace(line)
+		}
+		rest = rest[start:]
+
+		end := bytes.IndexByte(rest, ']')
+		if end < 0 {
+			return nil, bytes.TrimSpace(line)
+		}
+
+		if _, ok := logLevels[string(rest[:end+1])]; ok {
+			return rest[:end+1], bytes.TrimSpace(rest[end+1:])
+		}
+
+		rest = rest[1:]
+	}
 }
 
 func (l *LoggingBridge) logMessageAtLevel(message []byte, level []byte) {
 	if l.testing {
-		l.lastLevel = level
-		l.lastMessage = message
+		l.lastLevel = append([]byte(nil), level...)
+		l.lastMessage = append([]byte(nil), message...)
 	}
-	switch string(level) {
-	case "[INFO]":
-		log.Info(string(message))
-	case "[WARN]":
-		log.Warn(string(message))
-	case "[ERR]":
-		log.Error(string(message))
-	case "[DEBUG]":
-		log.Debug(string(message))
-	default:
-		log.Infof("%s %s", string(level), string(message))
+
+	logger := l.logger.get()
+	if logFn, ok := logLevels[string(level)]; ok {
+		logFn(logger, string(message))
+		return
 	}
+
+	logger.Info(string(message))
 }
@@ -4,6 +4,8 @@ package ringman
 // http://github.com/Nitro/sidecar
 
 import (
+	"bytes"
+	"reflect"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -14,12 +16,12 @@ func Test_LoggingBridge(t *testing.T) {
 		bridge := LoggingBridge{testing: true}
 
 		Convey("Properly splits apart and re-levels log messages", func() {
-			bridge.Write([]byte("2016/06/24 11:45:33 [DEBUG] memberlist: TCP connection from=172.16.106.1:59598"))
+			bridge.Write([]byte("2016/06/24 11:45:33 [DEBUG] memberlist: TCP connection from=172.16.106.1:59598\n"))
 
 			So(string(bridge.lastLevel), ShouldEqual, "[DEBUG]")
 			So(string(bridge.lastMessage), ShouldEqual, "memberlist: TCP connection from=172.16.106.1:59598")
 
-			bridge.Write([]byte("2016/06/24 11:45:33 [WARN] memberlist: Something something"))
+			bridge.Write([]byte("2016/06/24 11:45:33 [WARN] memberlist: Something something\n"))
 
 			So(string(bridge.lastLevel), ShouldEqual, "[WARN]")
 			So(string(bridge.lastMessage), ShouldEqual, "memberlist: Something something")
@@ -32,5 +34,154 @@ func Test_LoggingBridge(t *testing.T) {
 
 			So(string(bridge.lastMessage), ShouldEqual, "memberlist: TCP connection from=172.16.106.1:59598")
 		})
+
+		Convey("Consumes all of the data written", func() {
+			data := []byte("2016/06/24 11:45:33 [DEBUG] memberlist: one\n2016/06/24 11:45:33 [INFO] memberlist: two\n")
+			n, err := bridge.Write(data)
+
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(data))
+		})
+
+		Convey("Logs every line in a write", func() {
+			logger := &recordingLogger{}
+			bridge.SetLogger(logger)
+
+			bridge.Write([]byte("2016/06/24 11:45:33 [DEBUG] memberlist: one\n2016/06/24 11:45:33 [ERR] memberlist: two\n"))
+
+			So(len(logger.messages), ShouldEqual, 2)
+			So(logger.messages[0], ShouldResemble, loggedMessage{"debug", "memberlist: one", map[string]interface{}{}})
+			So(logger.messages[1], ShouldResemble, loggedMessage{"error", "memberlist: two", map[string]interface{}{}})
+		})
+
+		Convey("Buffers partial lines until the rest arrives", func() {
+			logger := &recordingLogger{}
+			bridge.SetLogger(logger)
+
+			bridge.Write([]byte("2016/06/24 11:45:33 [WA"))
+			So(len(logger.messages), ShouldEqual, 0)
+
+			bridge.Write([]byte("RN] memberlist: split"))
+			So(len(logger.messages), ShouldEqual, 0)
+
+			bridge.Write([]byte(" up\n"))
+			So(len(logger.messages), ShouldEqual, 1)
+			So(logger.messages[0].Level, ShouldEqual, "warn")
+			So(logger.messages[0].Message, ShouldEqual, "memberlist: split up")
+		})
+
+		Convey("Logs a partial line on Flush", func() {
+			logger := &recordingLogger{}
+			bridge.SetLogger(logger)
+
+			bridge.Write([]byte("[INFO] memberlist: no newline"))
+			bridge.Flush()
+
+			So(len(logger.messages), ShouldEqual, 1)
+			So(logger.messages[0].Message, ShouldEqual, "memberlist: no newline")
+		})
+
+		Convey("Logs overly long lines in pieces", func() {
+			logger := &recordingLogger{}
+			bridge.SetLogger(logger)
+
+			bridge.Write(bytes.Repeat([]byte("a"), MaxLogLineLength+10))
+
+			So(len(logger.messages), ShouldEqual, 1)
+			So(len(logger.messages[0].Message), ShouldEqual, MaxLogLineLength)
+			So(len(bridge.pending), ShouldEqual, 10)
+		})
+
+		Convey("Logs overly long lines in pieces when the newline comes with them", func() {
+			logger := &recordingLogger{}
+			bridge.SetLogger(logger)
+
+			line := append(bytes.Repeat([]byte("a"), MaxLogLineLength+10), '\n')
+			bridge.Write(line)
+
+			So(len(logger.messages), ShouldEqual, 2)
+			So(len(logger.messages[0].Message), ShouldEqual, MaxLogLineLength)
+			So(len(logger.messages[1].Message), ShouldEqual, 10)
+			So(len(bridge.pending), ShouldEqual, 0)
+		})
+
+		Convey("Finds the level whatever the prefix", func() {
+			prefixes := []string{
+				"",
+				"2016/06/24 11:45:33 ",
+				"2016/06/24 11:45:33.123456 ",
+				"11:45:33 memberlist.go:123: ",
+				"memberlist ",
+			}
+
+			for _, prefix := range prefixes {
+				bridge.Write([]byte(prefix + "[TRACE] memberlist: some [bracketed] thing\n"))
+
+				So(string(bridge.lastLevel), ShouldEqual, "[TRACE]")
+				So(string(bridge.lastMessage), ShouldEqual, "memberlist: some [bracketed] thing")
+			}
+		})
+
+		Convey("Logs lines without a level at Info", func() {
+			logger := &recordingLogger{}
+			bridge.SetLogger(logger)
+
+			bridge.Write([]byte("x\n[\n] [FOO] memberlist: odd\n\n"))
+
+			So(len(logger.messages), ShouldEqual, 3)
+			So(logger.messages[0], ShouldResemble, loggedMessage{"info", "x", map[string]interface{}{}})
+			So(logger.messages[1].Message, ShouldEqual, "[")
+			So(logger.messages[2].Message, ShouldEqual, "] [FOO] memberlist: odd")
+		})
+
+		Convey("Maps TRACE to Debug", func() {
+			logger := &recordingLogger{}
+			bridge.SetLogger(logger)
+
+			bridge.Write([]byte("[TRACE] memberlist: very chatty\n"))
+
+			So(logger.messages[0].Level, ShouldEqual, "debug")
+		})
+	})
+}
+
+// FuzzLoggingBridge makes sure that no input panics, that all of it is
+// consumed, and that how it is split into writes doesn't change what's logged.
+func FuzzLoggingBridge(f *testing.F) {
+	f.Add([]byte("2016/06/24 11:45:33 [DEBUG] memberlist: TCP connection from=172.16.106.1:59598\n"), 10)
+	f.Add([]byte("[TRACE] a\n[INFO]\n[ERR] b [WARN] c\nno level\n"), 3)
+	f.Add([]byte("[[]]\n["), 1)
+	f.Add([]byte(""), 0)
+
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		if split < 0 || split > len(data) {
+			split = len(data) / 2
+		}
+
+		whole := &recordingLogger{}
+		wholeBridge := &LoggingBridge{}
+		wholeBridge.SetLogger(whole)
+
+		n, err := wholeBridge.Write(data)
+		if err != nil || n != len(data) {
+			t.Fatalf("Write() returned %d, %v for %d bytes", n, err, len(data))
+		}
+		wholeBridge.Flush()
+
+		pieces := &recordingLogger{}
+		piecesBridge := &LoggingBridge{}
+		piecesBridge.SetLogger(pieces)
+
+		for _, piece := range [][]byte{data[:split], data[split:]} {
+			n, err := piecesBridge.Write(piece)
+			if err != nil || n != len(piece) {
+				t.Fatalf("Write() returned %d, %v for %d bytes", n, err, len(piece))
+			}
+		}
+		piecesBridge.Flush()
+
+		if !reflect.DeepEqual(whole.messages, pieces.messages) {
+			t.Fatalf("Split writes logged %v, one write logged %v", pieces.messages, whole.messages)
+		}
 	})
 }
@@ -0,0 +1,124 @@
+package ringman
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	MaxLookupBodySize = 10 * 1024 * 1024 // The most we'll read from a /nodes/lookup request
+)
+
+// GetNodesForKeys looks up the owner of each of the keys and returns them
+// grouped by node. All of the keys are looked up in the same version of the
+// ring, without a trip through the Run loop for each.
+func (r *HashRingManager) GetNodesForKeys(keys []string) (map[string][]string, error) {
+	owners, _, err := r.GetNodesForKeysWithVersion(keys)
+	return owners, err
+}
+
+// GetNodesForKeysWithVersion is like GetNodesForKeys but also returns the
+// version of the ring the answer came from.
+func (r *HashRingManager) GetNodesForKeysWithVersion(keys []string) (map[string][]string, uint64, error) {
+	snap, err := r.Snapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	owners := make(map[string][]string)
+	for _, key := range keys {
+		node, err := r.nodeFromSnapshot(snap, key)
+		if err != nil {
+			return nil, snap.Version, err
+		}
+
+		owners[node] = append(owners[node], key)
+	}
+
+	return owners, snap.Version, nil
+}
+
+// httpLookup serves a /nodes/lookup request against the manager. The request
+// body is a JSON array of keys, and the response groups them by the node that
+// owns them.
+func httpLookup(w http.ResponseWriter, req *http.Request, manager *HashRingManager) {
+	defer req.Body.Close()
+
+	if req.Method != http.MethodPost {
+		http.Error(w, `{"status": "error", "message": "Method not allowed"}`, 405)
+		return
+	}
+
+	var keys []string
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MaxLookupBodySize)).Decode(&keys)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, `{"status": "error", "message": "Request body too large"}`, 413)
+			return
+		}
+
+		http.Error(w, `{"status": "error", "message": "Invalid keys"}`, 400)
+		return
+	}
+
+	owners, version, err := manager.GetNodesForKeysWithVersion(keys)
+	if err != nil && err != ErrNoNodes {
+		http.Error(w, `{"status": "error", "message": "Unable to look up keys"}`, 500)
+		return
+	}
+
+	if owners == nil {
+		owners = map[string][]string{}
+	}
+
+	respObj := struct {
+		Nodes   map[string][]string
+		Version uint64
+	}{owners, version}
+
+	jsonBytes, err := json.MarshalIndent(respObj, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
+
+// httpGetNode serves a /nodes/get request for the key against the manager,
+// returning the node that owns it, and its replicas if they were asked for.
+func httpGetNode(w http.ResponseWriter, req *http.Request, manager *HashRingManager, key string) {
+	replicas, err := replicasFromRequest(req)
+	if err != nil {
+		http.Error(w, `{"status": "error", "message": "Invalid replicas"}`, 400)
+		return
+	}
+
+	var node string
+	var nodes []string
+	var version uint64
+	if replicas > 0 {
+		nodes, version, _ = manager.GetNodesWithVersion(key, replicas)
+		if len(nodes) > 0 {
+			node = nodes[0]
+		}
+	} else {
+		node, version, _ = manager.GetNodeWithVersion(key)
+	}
+
+	respObj := struct {
+		Node    string
+		Nodes   []string `json:",omitempty"`
+		Key     string
+		Version uint64
+	}{node, nodes, key, version}
+
+	jsonBytes, err := json.MarshalIndent(respObj, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,114 @@
+package ringman
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_GetNodesForKeys(t *testing.T) {
+	Convey("GetNodesForKeys()", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal", "kjartan", "gunnar"})
+		keys := placementKeys(500)
+
+		Convey("groups each key under its owner", func() {
+			owners, err := ringMgr.GetNodesForKeys(keys)
+			So(err, ShouldBeNil)
+
+			count := 0
+			for node, nodeKeys := range owners {
+				for _, key := range nodeKeys {
+					owner, _ := ringMgr.GetNode(key)
+					So(owner, ShouldEqual, node)
+				}
+				count += len(nodeKeys)
+			}
+			So(count, ShouldEqual, len(keys))
+			So(len(owners), ShouldEqual, 3)
+		})
+
+		Convey("returns the version it used", func() {
+			_, version, err := ringMgr.GetNodesForKeysWithVersion(keys)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, ringMgr.Version())
+		})
+
+		Convey("returns an empty grouping for no keys", func() {
+			owners, err := ringMgr.GetNodesForKeys(nil)
+			So(err, ShouldBeNil)
+			So(owners, ShouldBeEmpty)
+		})
+
+		Convey("returns an error on an empty ring", func() {
+			empty := NewHashRingManager([]string{})
+			_, err := empty.GetNodesForKeys(keys)
+			So(err, ShouldEqual, ErrNoNodes)
+		})
+	})
+}
+
+func Test_HttpLookupHandler(t *testing.T) {
+	Convey("HttpLookupHandler()", t, func() {
+		ring := &MemberlistRing{managedRing: managedRing{manager: NewHashRingManager([]string{"njal", "kjartan"})}}
+		recorder := httptest.NewRecorder()
+
+		Convey("returns owners grouped by node", func() {
+			req := httptest.NewRequest("POST", "/nodes/lookup", strings.NewReader(`["foo", "bar", "baz"]`))
+			ring.HttpLookupHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 200)
+
+			var resp struct {
+				Nodes   map[string][]string
+				Version uint64
+			}
+			So(json.NewDecoder(recorder.Result().Body).Decode(&resp), ShouldBeNil)
+
+			expected, _ := ring.manager.GetNodesForKeys([]string{"foo", "bar", "baz"})
+			So(resp.Nodes, ShouldResemble, expected)
+			So(resp.Version, ShouldEqual, 0)
+		})
+
+		Convey("only accepts a POST", func() {
+			req := httptest.NewRequest("GET", "/nodes/lookup", nil)
+			ring.HttpLookupHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 405)
+		})
+
+		Convey("returns a 400 on a bad body", func() {
+			req := httptest.NewRequest("POST", "/nodes/lookup", strings.NewReader(`{"key": "foo"}`))
+			ring.HttpLookupHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 400)
+		})
+
+		Convey("returns a 413 on a body that is too large", func() {
+			body := `["` + strings.Repeat("a", MaxLookupBodySize) + `"]`
+			req := httptest.NewRequest("POST", "/nodes/lookup", strings.NewReader(body))
+			ring.HttpLookupHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 413)
+		})
+
+		Convey("returns no owners from an empty ring", func() {
+			ring.manager = NewHashRingManager([]string{})
+			req := httptest.NewRequest("POST", "/nodes/lookup", strings.NewReader(`["foo"]`))
+			ring.HttpLookupHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, `"Nodes": {}`)
+		})
+
+		Convey("returns a 500 on a ring without a manager", func() {
+			broken := &SidecarRing{}
+			req := httptest.NewRequest("POST", "/nodes/lookup", strings.NewReader(`["foo"]`))
+			broken.HttpLookupHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 500)
+		})
+	})
+}
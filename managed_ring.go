@@ -0,0 +1,117 @@
+package ringman
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/relistan/go-director"
+)
+
+// managedRing is the part of a Ring that doesn't depend on how its members
+// are discovered: the running HashRingManager, which node is ours, and the
+// HTTP handlers. Rings embed it and keep it up to date with their backend.
+type managedRing struct {
+	managerLooper director.Looper
+	manager       *HashRingManager
+	localNode     atomic.Value // Holds our own key in the ring, as a string
+	logger        loggerRef
+	stopOnce      sync.Once
+}
+
+// startManager creates an empty HashRingManager and runs it until
+// stopManager is called.
+func (r *managedRing) startManager() {
+	r.manager = NewHashRingManager([]string{})
+	r.managerLooper = director.NewFreeLooper(director.FOREVER, nil)
+	go r.manager.Run(r.managerLooper)
+}
+
+// stopManager stops the HashRingManager and waits for it to finish.
+func (r *managedRing) stopManager() {
+	r.manager.Stop()
+	<-r.manager.Done()
+	r.managerLooper.Quit()
+}
+
+// shutdown runs stop the first time the ring is shut down, and does nothing
+// after that, so every ring is safe to shut down more than once. stop should
+// stop whatever the ring watches and then call stopManager.
+func (r *managedRing) shutdown(stop func()) {
+	r.stopOnce.Do(stop)
+}
+
+// setLocalNode records which node in the ring is this one.
+func (r *managedRing) setLocalNode(id string) {
+	r.localNode.Store(id)
+}
+
+// LocalNode returns this node's name in the ring, or "" if it isn't known.
+func (r *managedRing) LocalNode() string {
+	localNode, _ := r.localNode.Load().(string)
+	return localNode
+}
+
+// IsLocal reports whether this node owns the key.
+func (r *managedRing) IsLocal(key string) bool {
+	return isLocal(r.manager, r.LocalNode(), key)
+}
+
+// HttpListNodesHandler is an http.Handler that will return a JSON-encoded list of
+// the Nodes in the current ring.
+func (r *managedRing) HttpListNodesHandler(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	httpListNodes(w, r.manager)
+}
+
+// HttpGetNodeHandler is an http.Handler that will return an object containing the
+// node that currently owns a specific key. If the replicas parameter is passed,
+// the object will also contain that many nodes, in ring order, for the key.
+// The Version is the version of the ring the answer came from.
+func (r *managedRing) HttpGetNodeHandler(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	key := req.FormValue("key")
+	if key == "" {
+		http.Error(w, `{"status": "error", "message": "Invalid key"}`, 404)
+		return
+	}
+
+	httpGetNode(w, req, r.manager, key)
+}
+
+// HttpLookupHandler is an http.Handler that accepts a POST with a JSON array of
+// keys, and returns an object that groups them by the node that owns them.
+func (r *managedRing) HttpLookupHandler(w http.ResponseWriter, req *http.Request) {
+	httpLookup(w, req, r.manager)
+}
+
+// HttpMux returns an http.ServeMux configured to run the HTTP handlers on the
+// ring. You can either use this one, or mount the handlers on a mux of your
+// own choosing (e.g. Gorilla mux or httprouter)
+//
+// If NewMetrics was called on the ring's Manager, the mux also serves them
+// from /metrics.
+func (r *managedRing) HttpMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes/get", r.HttpGetNodeHandler)
+	mux.HandleFunc("/nodes/lookup", r.HttpLookupHandler)
+	mux.HandleFunc("/nodes", r.HttpListNodesHandler)
+
+	if metrics := r.manager.Metrics(); metrics != nil {
+		mux.Handle("/metrics", metrics.Handler())
+	}
+
+	return mux
+}
+
+// SetLogger sets the Logger for the ring and for its HashRingManager.
+func (r *managedRing) SetLogger(logger Logger) {
+	r.logger.set(logger)
+	r.manager.SetLogger(logger)
+}
+
+func (r *managedRing) Manager() *HashRingManager {
+	return r.manager
+}
@@ -1,14 +1,15 @@
 package ringman
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/Nitro/memberlist"
-	"github.com/relistan/go-director"
-	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DrainBroadcastTimeout = 5 * time.Second // How long Drain waits for gossip to go out
 )
 
 // A MemberlistRing is a ring backed by Hashicorp's Memberlist directly. It
@@ -16,9 +17,10 @@ import (
 // requires some open ports for them to communicate with each other. The nodes
 // will need to have some seeds provided that allow them to find each other.
 type MemberlistRing struct {
-	Memberlist    *memberlist.Memberlist
-	manager       *HashRingManager
-	managerLooper director.Looper
+	managedRing
+	Memberlist *memberlist.Memberlist
+	delegate   *Delegate
+	bridge     *LoggingBridge // Only set if we created it
 }
 
 // Ensure MemberlistRing implements Ring interface
@@ -44,20 +46,49 @@ func NewDefaultMemberlistRing(clusterSeeds []string, port string) (*MemberlistRi
 func NewMemberlistRing(mlConfig *memberlist.Config, clusterSeeds []string, port string,
 	clusterName string) (*MemberlistRing, error) {
 
+	return NewMemberlistRingWithMetadata(
+		mlConfig, clusterSeeds, &NodeMetadata{ServicePort: port}, clusterName,
+	)
+}
+
+// NewMemberlistRingWithMetadata configures a MemberlistRing like
+// NewMemberlistRing does, but advertises the NodeMetadata provided to the
+// rest of the cluster. This is how to give the node a Weight in the ring.
+// Memberlist limits the metadata to memberlist.MetaMaxSize bytes once
+// encoded, and an error is returned if it is larger.
+func NewMemberlistRingWithMetadata(mlConfig *memberlist.Config, clusterSeeds []string,
+	meta *NodeMetadata, clusterName string) (*MemberlistRing, error) {
+
+	if meta == nil {
+		return nil, fmt.Errorf("NodeMetadata must not be nil")
+	}
+
+	err := checkMetadataSize(meta)
+	if err != nil {
+		return nil, err
+	}
+
 	if clusterSeeds == nil {
 		clusterSeeds = []string{}
 	}
 
+	var bridge *LoggingBridge
 	if mlConfig.LogOutput == nil {
-		mlConfig.LogOutput = &LoggingBridge{}
+		bridge = &LoggingBridge{}
+		mlConfig.LogOutput = bridge
 	}
 
 	mlConfig.ClusterName = clusterName
 
+	// Keep our own copy, so draining doesn't change the caller's, and they
+	// can't change it underneath us
+	ourMeta := *meta
+	ourMeta.Labels = copyMetadata(meta.Labels)
+
 	// We need to set up the delegate first, so we join the ring with
 	// meta-data (otherwise our service port gets skipped over). We'll give
 	// it a real ring manager a few lines down.
-	delegate := NewDelegate(nil, &NodeMetadata{ServicePort: port})
+	delegate := NewDelegate(nil, &ourMeta)
 	mlConfig.Delegate = delegate
 	mlConfig.Events = delegate
 
@@ -66,16 +97,26 @@ func NewMemberlistRing(mlConfig *memberlist.Config, clusterSeeds []string, port
 		return nil, fmt.Errorf("Unable to create Memberlist cluster: %s", err)
 	}
 
-	ringMgr := NewHashRingManager([]string{})
-	looper := director.NewFreeLooper(director.FOREVER, nil)
-	go ringMgr.Run(looper)
+	mlRing := &MemberlistRing{
+		Memberlist: list,
+		delegate:   delegate,
+		bridge:     bridge,
+	}
+	mlRing.startManager()
 
 	// Wait for the RingManager to be ready before proceeding
-	if !ringMgr.Ping() {
+	if !mlRing.manager.Ping() {
 		return nil, fmt.Errorf("Unable to initialize the HashRingManager")
 	}
 
-	delegate.RingMan = ringMgr
+	delegate.RingMan = mlRing.manager
+
+	// We're named the same way the Delegate names every other node, from our
+	// address and ServicePort, which don't change once we're created.
+	localNode, err := delegate.keyForNode(list.LocalNode())
+	if err == nil {
+		mlRing.setLocalNode(localNode)
+	}
 
 	// Make sure we have all the nodes added, using the callback in
 	// the delegate, which does the right thing.
@@ -88,37 +129,65 @@ func NewMemberlistRing(mlConfig *memberlist.Config, clusterSeeds []string, port
 		return nil, fmt.Errorf("Unable to join Memberlist cluster: %s", err)
 	}
 
-	return &MemberlistRing{
-		Memberlist:    list,
-		manager:       ringMgr,
-		managerLooper: looper,
-	}, nil
+	return mlRing, nil
 }
 
-// HttpListNodesHandler is an http.Handler that will return a JSON-encoded list of
-// the Memberlist nodes in the current ring.
-func (r *MemberlistRing) HttpListNodesHandler(w http.ResponseWriter, req *http.Request) {
-	defer req.Body.Close()
+// HttpMux returns an http.ServeMux configured to run the HTTP handlers on the
+// MemberlistRing, including the one that drains it. You can either use this
+// one, or mount the handlers on a mux of your own choosing (e.g. Gorilla mux
+// or httprouter)
+//
+// If NewMetrics was called on the ring's Manager, the mux also serves them
+// from /metrics.
+func (r *MemberlistRing) HttpMux() *http.ServeMux {
+	mux := r.managedRing.HttpMux()
+	mux.HandleFunc("/drain", r.HttpDrainHandler)
+
+	return mux
+}
+
+// SetLogger sets the Logger for the ring, and for its HashRingManager,
+// Delegate and the LoggingBridge that carries Memberlist's own output.
+func (r *MemberlistRing) SetLogger(logger Logger) {
+	r.managedRing.SetLogger(logger)
+	r.delegate.SetLogger(logger)
+
+	if r.bridge != nil {
+		r.bridge.SetLogger(logger)
+	}
+}
 
-	list := r.Memberlist.Members()
+// Drain marks this node as draining and gossips that to the rest of the
+// cluster. Each member then moves the keys this node owns to other nodes,
+// while still letting lookups find it with GetHandoffNode. Once the keys are
+// handed off, call Shutdown to leave the cluster.
+func (r *MemberlistRing) Drain() error {
+	err := r.delegate.setDraining(true)
+	if err != nil {
+		return err
+	}
 
-	jsonBytes, err := json.MarshalIndent(&list, "", "  ")
+	err = r.Memberlist.UpdateNode(DrainBroadcastTimeout)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return fmt.Errorf("Unable to broadcast drain: %s", err)
+	}
+
+	// Don't wait on Memberlist to tell us about ourselves
+	nodeKey, err := r.delegate.keyForNode(r.Memberlist.LocalNode())
+	if err != nil {
+		return err
 	}
 
-	w.Write(jsonBytes)
+	return r.manager.SetDraining(nodeKey, true)
 }
 
-// HttpGetNodeHandler is an http.Handler that will return an object containing the
-// node that currently owns a specific key.
-func (r *MemberlistRing) HttpGetNodeHandler(w http.ResponseWriter, req *http.Request) {
+// HttpDrainHandler is an http.Handler that drains this node when it receives
+// a POST.
+func (r *MemberlistRing) HttpDrainHandler(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 
-	key := req.FormValue("key")
-	if key == "" {
-		http.Error(w, `{"status": "error", "message": "Invalid key"}`, 404)
+	if req.Method != http.MethodPost {
+		http.Error(w, `{"status": "error", "message": "Method not allowed"}`, 405)
 		return
 	}
 
@@ -127,48 +196,33 @@ func (r *MemberlistRing) HttpGetNodeHandler(w http.ResponseWriter, req *http.Req
 		return
 	}
 
-	node, _ := r.manager.GetNode(key)
-
-	respObj := struct {
-		Node string
-		Key  string
-	}{node, key}
-
-	jsonBytes, err := json.MarshalIndent(respObj, "", "  ")
+	err := r.Drain()
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		r.logger.get().Error("Unable to drain", "error", err)
+		http.Error(w, `{"status": "error", "message": "Unable to drain"}`, 500)
+		return
 	}
 
-	w.Write(jsonBytes)
-}
-
-// HttpMux returns an http.ServeMux configured to run the HTTP handlers on the
-// MemberlistRing. You can either use this one, or mount the handlers on a mux of your
-// own choosing (e.g. Gorilla mux or httprouter)
-func (r *MemberlistRing) HttpMux() *http.ServeMux {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/nodes/get", r.HttpGetNodeHandler)
-	mux.HandleFunc("/nodes", r.HttpListNodesHandler)
-	return mux
-}
-
-func (r *MemberlistRing) Manager() *HashRingManager {
-	return r.manager
+	w.Write([]byte(`{"status": "ok"}`))
 }
 
 // Shutdown shuts down the memberlist node and stops the HashRingManager
 func (r *MemberlistRing) Shutdown() {
-	err := r.Memberlist.Leave(2 * time.Second) // 2 second timeout
-	if err != nil {
-		log.Debugf("Failed to leave Memberlist cluster: %s", err)
-	}
-
-	err = r.Memberlist.Shutdown()
-	if err != nil {
-		log.Debugf("Failed to shutdown Memberlist: %s", err)
-	}
-
-	r.manager.Stop()
-
-	r.managerLooper.Quit()
+	r.shutdown(func() {
+		err := r.Memberlist.Leave(2 * time.Second) // 2 second timeout
+		if err != nil {
+			r.logger.get().Debug("Failed to leave Memberlist cluster", "error", err)
+		}
+
+		err = r.Memberlist.Shutdown()
+		if err != nil {
+			r.logger.get().Debug("Failed to shutdown Memberlist", "error", err)
+		}
+
+		if r.bridge != nil {
+			r.bridge.Flush()
+		}
+
+		r.stopManager()
+	})
 }
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/Nitro/memberlist"
@@ -34,6 +35,48 @@ func Test_NewMemberlistRing(t *testing.T) {
 	})
 }
 
+func Test_NewMemberlistRingWithMetadata(t *testing.T) {
+	Convey("NewMemberlistRingWithMetadata()", t, func() {
+		Convey("rejects metadata too large to gossip", func() {
+			meta := &NodeMetadata{
+				ServicePort: "8000",
+				Labels:      map[string]string{"notes": strings.Repeat("x", memberlist.MetaMaxSize)},
+			}
+
+			mlistRing, err := NewMemberlistRingWithMetadata(
+				memberlist.DefaultLANConfig(), []string{}, meta, "default",
+			)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "more than")
+			So(mlistRing, ShouldBeNil)
+		})
+
+		Convey("keeps its own copy of the metadata", func() {
+			mlConfig := memberlist.DefaultLANConfig()
+			mlConfig.BindPort = 35003
+
+			meta := &NodeMetadata{
+				ServicePort: "8000",
+				Labels:      map[string]string{"zone": "us-east-1a"},
+			}
+
+			mlistRing, err := NewMemberlistRingWithMetadata(mlConfig, []string{}, meta, "default")
+			So(err, ShouldBeNil)
+			defer mlistRing.Shutdown()
+
+			meta.Labels["zone"] = "us-west-2b"
+			So(mlistRing.Drain(), ShouldBeNil)
+
+			So(meta.Draining, ShouldBeFalse)
+
+			ourMeta, err := DecodeNodeMetadata(mlistRing.Memberlist.LocalNode().Meta)
+			So(err, ShouldBeNil)
+			So(ourMeta.Draining, ShouldBeTrue)
+			So(ourMeta.Labels["zone"], ShouldEqual, "us-east-1a")
+		})
+	})
+}
+
 func Test_MemberListRingShutdown(t *testing.T) {
 	Convey("NewMemberlistRing()", t, func() {
 		mlistRing, err := NewDefaultMemberlistRing([]string{}, "8000")
@@ -42,7 +85,9 @@ func Test_MemberListRingShutdown(t *testing.T) {
 		mlistRing.Shutdown()
 
 		So(mlistRing.manager.Ping(), ShouldBeFalse)
-		So(mlistRing.manager.cmdChan, ShouldBeNil)
+		So(mlistRing.manager.State(), ShouldEqual, ManagerStopped)
+
+		So(func() { mlistRing.Shutdown() }, ShouldNotPanic)
 	})
 }
 
@@ -75,3 +120,67 @@ func Test_HttpGetNodeHandler(t *testing.T) {
 		})
 	})
 }
+
+func Test_MemberlistRingLocalNode(t *testing.T) {
+	mlConfig := memberlist.DefaultLANConfig()
+	mlConfig.BindPort = 35003
+
+	Convey("LocalNode() and IsLocal()", t, func() {
+		mlistRing, err := NewMemberlistRing(mlConfig, []string{}, "8000", "default")
+		So(err, ShouldBeNil)
+
+		ourKey := mlistRing.Memberlist.LocalNode().Addr.String() + ":8000"
+		otherKey := "10.0.0.1:8000"
+		So(mlistRing.Manager().AddNode(otherKey), ShouldBeNil)
+
+		Convey("LocalNode() is our own key in the ring", func() {
+			So(mlistRing.LocalNode(), ShouldEqual, ourKey)
+		})
+
+		Convey("IsLocal() is true for a key we own", func() {
+			So(mlistRing.IsLocal(keyOwnedBy(mlistRing.Manager(), ourKey)), ShouldBeTrue)
+		})
+
+		Convey("IsLocal() is false for a key another node owns", func() {
+			So(mlistRing.IsLocal(keyOwnedBy(mlistRing.Manager(), otherKey)), ShouldBeFalse)
+		})
+
+		Reset(func() { mlistRing.Shutdown() })
+	})
+}
+
+func Test_MemberlistRingDrain(t *testing.T) {
+	mlConfig := memberlist.DefaultLANConfig()
+	mlConfig.BindPort = 35002
+
+	Convey("HttpDrainHandler()", t, func() {
+		mlistRing, err := NewMemberlistRing(mlConfig, []string{}, "8000", "default")
+		So(err, ShouldBeNil)
+
+		ourKey := mlistRing.Memberlist.LocalNode().Addr.String() + ":8000"
+		recorder := httptest.NewRecorder()
+
+		Convey("only accepts a POST", func() {
+			req := httptest.NewRequest("GET", "/drain", nil)
+			mlistRing.HttpDrainHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 405)
+		})
+
+		Convey("drains the node", func() {
+			req := httptest.NewRequest("POST", "/drain", nil)
+			mlistRing.HttpDrainHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 200)
+
+			snap, _ := mlistRing.Manager().Snapshot()
+			So(snap.IsDraining(ourKey), ShouldBeTrue)
+
+			meta, err := DecodeNodeMetadata(mlistRing.Memberlist.LocalNode().Meta)
+			So(err, ShouldBeNil)
+			So(meta.Draining, ShouldBeTrue)
+		})
+
+		Reset(func() { mlistRing.Shutdown() })
+	})
+}
@@ -0,0 +1,168 @@
+package ringman
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics is a Prometheus collector for a HashRingManager. It reports the
+// size, version and pending commands of the ring, the share of keys each node
+// owns, how many membership changes have been applied, how long GetNode
+// takes, and the Memberlist events seen by the Delegate.
+type Metrics struct {
+	manager  *HashRingManager
+	registry *prometheus.Registry
+
+	changes      *prometheus.CounterVec
+	memberEvents *prometheus.CounterVec
+	lookups      prometheus.Histogram
+
+	sizeDesc      *prometheus.Desc
+	versionDesc   *prometheus.Desc
+	pendingDesc   *prometheus.Desc
+	ownershipDesc *prometheus.Desc
+
+	// Ownership is costly to work out, so we only do it once per version
+	ownershipLock    sync.Mutex
+	ownershipVersion uint64
+	ownership        map[string]float64
+}
+
+// Ensure Metrics implements the prometheus.Collector interface
+var _ prometheus.Collector = (*Metrics)(nil)
+
+// NewMetrics returns a Metrics collector for the HashRingManager and attaches
+// it, so that lookups and changes start being counted. Register it with the
+// host application's Prometheus registry, or let the ring serve it from
+// /metrics on its HttpMux. To collect from more than one manager in the same
+// registry, wrap it with prometheus.WrapRegistererWith and a distinct label.
+func NewMetrics(manager *HashRingManager) *Metrics {
+	m := &Metrics{
+		manager: manager,
+
+		changes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ringman",
+			Name:      "membership_changes_total",
+			Help:      "Changes applied to the ring, by type.",
+		}, []string{"type"}),
+
+		memberEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ringman",
+			Name:      "memberlist_events_total",
+			Help:      "Memberlist events received by the Delegate, by event.",
+		}, []string{"event"}),
+
+		lookups: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "ringman",
+			Name:      "get_node_duration_seconds",
+			Help:      "How long GetNode took to find the owner of a key.",
+			Buckets:   prometheus.ExponentialBuckets(0.0000001, 4, 10), // 100ns to ~26ms
+		}),
+
+		sizeDesc: prometheus.NewDesc(
+			"ringman_ring_nodes", "Nodes in the ring.", nil, nil,
+		),
+		versionDesc: prometheus.NewDesc(
+			"ringman_ring_version", "The current version of the ring.", nil, nil,
+		),
+		pendingDesc: prometheus.NewDesc(
+			"ringman_pending_commands", "Commands waiting for the Run loop.", nil, nil,
+		),
+		ownershipDesc: prometheus.NewDesc(
+			"ringman_node_ownership_ratio", "The share of keys owned by each node.",
+			[]string{"node"}, nil,
+		),
+	}
+
+	m.registry = prometheus.NewRegistry()
+	m.registry.MustRegister(m)
+
+	if manager != nil {
+		manager.metrics.Store(m)
+	}
+
+	return m
+}
+
+// Describe sends the descriptors of all the metrics we collect.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.changes.Describe(ch)
+	m.memberEvents.Describe(ch)
+	m.lookups.Describe(ch)
+
+	ch <- m.sizeDesc
+	ch <- m.versionDesc
+	ch <- m.pendingDesc
+	ch <- m.ownershipDesc
+}
+
+// Collect sends the current value of each metric.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.changes.Collect(ch)
+	m.memberEvents.Collect(ch)
+	m.lookups.Collect(ch)
+
+	ch <- prometheus.MustNewConstMetric(m.pendingDesc, prometheus.GaugeValue, float64(m.manager.Pending()))
+
+	snap, err := m.manager.Snapshot()
+	if err != nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.sizeDesc, prometheus.GaugeValue, float64(snap.Size()))
+	ch <- prometheus.MustNewConstMetric(m.versionDesc, prometheus.GaugeValue, float64(snap.Version))
+
+	for node, share := range m.ownershipOf(snap) {
+		ch <- prometheus.MustNewConstMetric(m.ownershipDesc, prometheus.GaugeValue, share, node)
+	}
+}
+
+// Handler returns an http.Handler that serves these metrics, and only these,
+// in the Prometheus format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ownershipOf returns the ownership shares for the snapshot, working them out
+// again only when the version has changed.
+func (m *Metrics) ownershipOf(snap *RingSnapshot) map[string]float64 {
+	m.ownershipLock.Lock()
+	defer m.ownershipLock.Unlock()
+
+	if m.ownership == nil || m.ownershipVersion != snap.Version {
+		m.ownership = snap.Ownership()
+		m.ownershipVersion = snap.Version
+	}
+
+	return m.ownership
+}
+
+// recordChange counts a change applied to the ring.
+func (m *Metrics) recordChange(evt RingEvent) {
+	m.changes.WithLabelValues(evt.Type.String()).Inc()
+}
+
+// recordLookup records how long a GetNode took, from the start time.
+func (m *Metrics) recordLookup(start time.Time) {
+	m.lookups.Observe(time.Since(start).Seconds())
+}
+
+// recordMemberEvent counts a Memberlist event seen by the Delegate.
+func (m *Metrics) recordMemberEvent(event string) {
+	m.memberEvents.WithLabelValues(event).Inc()
+}
+
+// Metrics returns the Metrics attached to the HashRingManager by NewMetrics,
+// or nil if there are none.
+func (r *HashRingManager) Metrics() *Metrics {
+	if r == nil {
+		return nil
+	}
+
+	m, _ := r.metrics.Load().(*Metrics)
+	return m
+}
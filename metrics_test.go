@@ -0,0 +1,144 @@
+package ringman
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Nitro/memberlist"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Metrics(t *testing.T) {
+	Convey("Metrics", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal", "kjartan"})
+		ringMgr.Start()
+		metrics := NewMetrics(ringMgr)
+
+		Convey("are attached to the manager", func() {
+			So(ringMgr.Metrics(), ShouldEqual, metrics)
+			So(NewHashRingManager(nil).Metrics(), ShouldBeNil)
+		})
+
+		Convey("report the ring size and version", func() {
+			ringMgr.AddNode("gunnar")
+
+			body := scrape(metrics)
+			So(body, ShouldContainSubstring, "ringman_ring_nodes 3")
+			So(body, ShouldContainSubstring, "ringman_ring_version 1")
+		})
+
+		Convey("count membership changes by type", func() {
+			ringMgr.AddNode("gunnar")
+			ringMgr.AddNode("hallgerd")
+			ringMgr.RemoveNode("njal")
+
+			So(testutil.ToFloat64(metrics.changes.WithLabelValues("NodeAdded")), ShouldEqual, 2)
+			So(testutil.ToFloat64(metrics.changes.WithLabelValues("NodeRemoved")), ShouldEqual, 1)
+		})
+
+		Convey("time lookups", func() {
+			ringMgr.GetNode("foo")
+			ringMgr.GetNode("bar")
+
+			body := scrape(metrics)
+			So(body, ShouldContainSubstring, "ringman_get_node_duration_seconds_count 2")
+		})
+
+		Convey("report each node's share of the keys", func() {
+			body := scrape(metrics)
+			So(body, ShouldContainSubstring, `ringman_node_ownership_ratio{node="njal"}`)
+			So(body, ShouldContainSubstring, `ringman_node_ownership_ratio{node="kjartan"}`)
+			So(body, ShouldContainSubstring, "ringman_pending_commands 0")
+		})
+
+		Convey("count Memberlist events from the Delegate", func() {
+			delegate := NewDelegate(ringMgr, &NodeMetadata{ServicePort: "8000"})
+			node := &memberlist.Node{
+				Name: "gunnar",
+				Addr: net.ParseIP("10.0.0.1"),
+				Meta: []byte(`{"ServicePort": "8000"}`),
+			}
+
+			delegate.NotifyJoin(node)
+			delegate.NotifyUpdate(node)
+			delegate.NotifyLeave(node)
+
+			So(testutil.ToFloat64(metrics.memberEvents.WithLabelValues("join")), ShouldEqual, 1)
+			So(testutil.ToFloat64(metrics.memberEvents.WithLabelValues("update")), ShouldEqual, 1)
+			So(testutil.ToFloat64(metrics.memberEvents.WithLabelValues("leave")), ShouldEqual, 1)
+		})
+
+		Convey("are served from the ring's HttpMux", func() {
+			ring := &SidecarRing{managedRing: managedRing{manager: ringMgr}}
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/metrics", nil)
+
+			ring.HttpMux().ServeHTTP(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, "ringman_ring_nodes 2")
+		})
+
+		Convey("are not served when they weren't asked for", func() {
+			ring := &SidecarRing{managedRing: managedRing{manager: NewHashRingManager(nil)}}
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/metrics", nil)
+
+			ring.HttpMux().ServeHTTP(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 404)
+		})
+
+		Reset(func() { ringMgr.Stop() })
+	})
+}
+
+func Test_Ownership(t *testing.T) {
+	Convey("Ownership()", t, func() {
+		weights := map[string]int{"njal": 1, "kjartan": 1, "gunnar": 2}
+
+		for name, placementFn := range allPlacements {
+			snap := newRingSnapshot(1, placementFn(weights), weights, nil)
+			shares := snap.Ownership()
+
+			Convey(name+" shares add up and follow weights", func() {
+				total := 0.0
+				for _, share := range shares {
+					total += share
+				}
+				So(total, ShouldAlmostEqual, 1.0, 0.0001)
+				So(shares["gunnar"], ShouldBeBetween, 0.35, 0.65)
+			})
+
+			Convey(name+" shares match where keys go", func() {
+				counts := make(map[string]float64)
+				keys := placementKeys(20000)
+				for _, key := range keys {
+					node, _ := snap.GetNode(key)
+					counts[node]++
+				}
+
+				for node, share := range shares {
+					So(math.Abs(counts[node]/float64(len(keys))-share), ShouldBeLessThan, 0.02)
+				}
+			})
+		}
+
+		Convey("is empty for an empty ring", func() {
+			snap := newRingSnapshot(0, NewHashringPlacement(nil), nil, nil)
+			So(snap.Ownership(), ShouldBeEmpty)
+		})
+	})
+}
+
+func scrape(metrics *Metrics) string {
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+	return string(body)
+}
@@ -0,0 +1,180 @@
+package ringman
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+const (
+	MaxToken = math.MaxUint32 // Tokens are the 32-bit positions on the ring
+)
+
+var (
+	ErrNoTokenRanges error = errors.New("Token ranges are only available with the hashring placement")
+)
+
+// A TokenRange is a contiguous, inclusive range of tokens on the ring whose
+// owner is different between two versions of the ring. From is empty when
+// the older ring had no nodes, and To is empty when the newer one has none.
+type TokenRange struct {
+	Start uint32
+	End   uint32
+	From  string
+	To    string
+}
+
+// Contains returns true if the token falls within the range.
+func (t TokenRange) Contains(token uint32) bool {
+	return token >= t.Start && token <= t.End
+}
+
+// KeyToken returns the position of a key on the ring, for comparing against
+// a TokenRange. Like the hashring, it uses the first four bytes of the MD5.
+func KeyToken(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[0:4])
+}
+
+// A KeyMove is a key whose owner differs between two versions of the ring.
+type KeyMove struct {
+	Key  string
+	From string
+	To   string
+}
+
+// A KeyMigration classifies a batch of keys by whether or not they changed
+// owners between two versions of the ring.
+type KeyMigration struct {
+	Stays []string
+	Moves []KeyMove
+}
+
+// tokens returns the points each node holds on the ring, sorted by token.
+// Only the hashring placement has tokens; the others return false.
+func (s *RingSnapshot) tokens() ([]ringToken, bool) {
+	placement, ok := s.placement.(*hashringPlacement)
+	if !ok {
+		return nil, false
+	}
+
+	return placement.tokens, true
+}
+
+// ownerOf returns the node owning a token: the one holding the first point
+// after it, wrapping around to the start of the ring.
+func ownerOf(tokens []ringToken, token uint32) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	pos := sort.Search(len(tokens), func(i int) bool { return tokens[i].token > token })
+	if pos == len(tokens) {
+		pos = 0
+	}
+
+	return tokens[pos].node
+}
+
+// Diff returns the token ranges whose owner changed between this snapshot
+// and the next one, in token order. Adjacent ranges moving between the same
+// pair of nodes are merged. Both snapshots must use the hashring placement,
+// since the other placements don't divide keys up into token ranges, and
+// ErrNoTokenRanges is returned otherwise. Use ClassifyKeys with those.
+func (s *RingSnapshot) Diff(next *RingSnapshot) ([]TokenRange, error) {
+	oldTokens, oldOk := s.tokens()
+	newTokens, newOk := next.tokens()
+	if !oldOk || !newOk {
+		return nil, ErrNoTokenRanges
+	}
+
+	// Ownership can only change at a point from one ring or the other, so
+	// we walk the intervals between all of them.
+	starts := []uint32{0}
+	for _, t := range oldTokens {
+		starts = append(starts, t.token)
+	}
+	for _, t := range newTokens {
+		starts = append(starts, t.token)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	var ranges []TokenRange
+	for i, start := range starts {
+		if i > 0 && start == starts[i-1] {
+			continue
+		}
+
+		end := uint32(MaxToken)
+		for j := i + 1; j < len(starts); j++ {
+			if starts[j] != start {
+				end = starts[j] - 1
+				break
+			}
+		}
+
+		from := ownerOf(oldTokens, start)
+		to := ownerOf(newTokens, start)
+		if from == to {
+			continue
+		}
+
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].End+1 == start &&
+			ranges[last].From == from && ranges[last].To == to {
+
+			ranges[last].End = end
+			continue
+		}
+
+		ranges = append(ranges, TokenRange{Start: start, End: end, From: from, To: to})
+	}
+
+	return ranges, nil
+}
+
+// ClassifyKeys sorts the keys into those that have the same owner in this
+// snapshot and the next one, and those that move from one node to another.
+func (s *RingSnapshot) ClassifyKeys(next *RingSnapshot, keys []string) *KeyMigration {
+	migration := &KeyMigration{}
+
+	for _, key := range keys {
+		// Errors only happen on an empty ring, where the owner is ""
+		from, _ := s.GetNode(key)
+		to, _ := next.GetNode(key)
+
+		if from == to {
+			migration.Stays = append(migration.Stays, key)
+			continue
+		}
+
+		migration.Moves = append(migration.Moves, KeyMove{Key: key, From: from, To: to})
+	}
+
+	return migration
+}
+
+// DiffSince returns the token ranges whose owner changed between the snapshot
+// provided and the current ring. Like Diff, it returns ErrNoTokenRanges
+// unless both use the hashring placement.
+func (r *HashRingManager) DiffSince(previous *RingSnapshot) ([]TokenRange, error) {
+	current, err := r.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return previous.Diff(current)
+}
+
+// ClassifyKeysSince sorts the keys by whether their owner changed between the
+// snapshot provided and the current ring.
+func (r *HashRingManager) ClassifyKeysSince(previous *RingSnapshot, keys []string) (*KeyMigration, error) {
+	current, err := r.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return previous.ClassifyKeys(current, keys), nil
+}
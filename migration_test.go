@@ -0,0 +1,195 @@
+package ringman
+
+import (
+	"fmt"
+	"testing"
+
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// ownerFromRanges looks up the new owner of a key from a diff, falling back
+// to the old owner if the key is not in any of the ranges.
+func ownerFromRanges(ranges []TokenRange, key string, oldOwner string) string {
+	token := KeyToken(key)
+	for _, tr := range ranges {
+		if tr.Contains(token) {
+			return tr.To
+		}
+	}
+
+	return oldOwner
+}
+
+func Test_RingSnapshotTokens(t *testing.T) {
+	Convey("RingSnapshot tokens()", t, func() {
+		weights := map[string]int{"njal": 1, "kjartan": 3, "gunnar": 2}
+		snap := newRingSnapshot(1, NewHashringPlacement(weights), weights, nil)
+		tokens, ok := snap.tokens()
+		So(ok, ShouldBeTrue)
+
+		Convey("match the owners chosen by the hashring", func() {
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				node, err := snap.GetNode(key)
+				So(err, ShouldBeNil)
+				So(ownerOf(tokens, KeyToken(key)), ShouldEqual, node)
+			}
+		})
+
+		Convey("are empty for an empty ring", func() {
+			empty := newRingSnapshot(0, NewHashringPlacement(nil), nil, nil)
+			tokens, ok := empty.tokens()
+			So(ok, ShouldBeTrue)
+			So(tokens, ShouldBeEmpty)
+			So(ownerOf(tokens, 1234), ShouldEqual, "")
+		})
+
+		Convey("are not available for other placements", func() {
+			for name, placementFn := range allPlacements {
+				if name == "hashring" {
+					continue
+				}
+
+				other := newRingSnapshot(1, placementFn(weights), weights, nil)
+				_, ok := other.tokens()
+				So(ok, ShouldBeFalse)
+
+				_, err := snap.Diff(other)
+				So(err, ShouldEqual, ErrNoTokenRanges)
+				_, err = other.Diff(snap)
+				So(err, ShouldEqual, ErrNoTokenRanges)
+			}
+		})
+	})
+}
+
+func Test_Diff(t *testing.T) {
+	Convey("Diff()", t, func() {
+		beforeWeights := map[string]int{"njal": 1, "kjartan": 1}
+		before := newRingSnapshot(1, NewHashringPlacement(beforeWeights), beforeWeights, nil)
+		afterWeights := map[string]int{"njal": 1, "kjartan": 1, "gunnar": 1}
+		after := newRingSnapshot(2, NewHashringPlacement(afterWeights), afterWeights, nil)
+
+		Convey("returns nothing when the rings are the same", func() {
+			ranges, err := before.Diff(before)
+			So(err, ShouldBeNil)
+			So(ranges, ShouldBeEmpty)
+		})
+
+		Convey("returns ordered ranges that don't overlap", func() {
+			ranges, err := before.Diff(after)
+			So(err, ShouldBeNil)
+			So(ranges, ShouldNotBeEmpty)
+
+			for i, tr := range ranges {
+				So(tr.Start, ShouldBeLessThanOrEqualTo, tr.End)
+				if i > 0 {
+					So(tr.Start, ShouldBeGreaterThan, ranges[i-1].End)
+				}
+			}
+		})
+
+		Convey("only moves ranges to a new node", func() {
+			ranges, _ := before.Diff(after)
+
+			for _, tr := range ranges {
+				So(tr.To, ShouldEqual, "gunnar")
+				So(tr.From, ShouldNotEqual, "gunnar")
+			}
+		})
+
+		Convey("covers exactly the keys that changed owners", func() {
+			changes := map[string][2]map[string]int{
+				"adding a node":    {beforeWeights, afterWeights},
+				"removing a node":  {afterWeights, beforeWeights},
+				"changing weights": {afterWeights, {"njal": 3, "kjartan": 1, "gunnar": 2}},
+			}
+
+			for name, change := range changes {
+				older := newRingSnapshot(1, NewHashringPlacement(change[0]), change[0], nil)
+				newer := newRingSnapshot(2, NewHashringPlacement(change[1]), change[1], nil)
+				ranges, err := older.Diff(newer)
+				So(err, ShouldBeNil)
+
+				moved := 0
+				for i := 0; i < 20000; i++ {
+					key := fmt.Sprintf("%s-%d", name, i)
+					oldOwner, _ := older.GetNode(key)
+					newOwner, _ := newer.GetNode(key)
+					if oldOwner != newOwner {
+						moved++
+					}
+
+					So(ownerFromRanges(ranges, key, oldOwner), ShouldEqual, newOwner)
+				}
+				So(moved, ShouldBeGreaterThan, 0)
+			}
+		})
+
+		Convey("moves the whole ring from an empty one", func() {
+			singleWeights := map[string]int{"njal": 1}
+			empty := newRingSnapshot(0, NewHashringPlacement(nil), nil, nil)
+			single := newRingSnapshot(1, NewHashringPlacement(singleWeights), singleWeights, nil)
+
+			ranges, err := empty.Diff(single)
+			So(err, ShouldBeNil)
+			So(ranges, ShouldResemble,
+				[]TokenRange{{Start: 0, End: MaxToken, From: "", To: "njal"}},
+			)
+		})
+	})
+}
+
+func Test_ClassifyKeys(t *testing.T) {
+	Convey("ClassifyKeys()", t, func() {
+		ringMgr := NewHashRingManager([]string{"njal", "kjartan"})
+		go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+		So(ringMgr.Ping(), ShouldBeTrue)
+
+		before, err := ringMgr.Snapshot()
+		So(err, ShouldBeNil)
+
+		var keys []string
+		for i := 0; i < 100; i++ {
+			keys = append(keys, fmt.Sprintf("key-%d", i))
+		}
+
+		Convey("finds the keys moving to a new node", func() {
+			ringMgr.AddNode("gunnar")
+
+			migration, err := ringMgr.ClassifyKeysSince(before, keys)
+			So(err, ShouldBeNil)
+			So(len(migration.Stays)+len(migration.Moves), ShouldEqual, len(keys))
+			So(migration.Moves, ShouldNotBeEmpty)
+
+			for _, move := range migration.Moves {
+				So(move.To, ShouldEqual, "gunnar")
+				So(move.From, ShouldNotEqual, "gunnar")
+			}
+
+			ranges, err := ringMgr.DiffSince(before)
+			So(err, ShouldBeNil)
+			So(ranges, ShouldNotBeEmpty)
+		})
+
+		Convey("finds the keys moving off a departed node", func() {
+			ringMgr.RemoveNode("njal")
+
+			migration, _ := ringMgr.ClassifyKeysSince(before, keys)
+			for _, move := range migration.Moves {
+				So(move.From, ShouldEqual, "njal")
+				So(move.To, ShouldEqual, "kjartan")
+			}
+
+			for _, key := range migration.Stays {
+				owner, _ := before.GetNode(key)
+				So(owner, ShouldEqual, "kjartan")
+			}
+		})
+
+		Reset(func() {
+			ringMgr.Stop()
+		})
+	})
+}
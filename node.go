@@ -0,0 +1,264 @@
+package ringman
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// NodeState is whether a node is taking keys, or handing them off.
+type NodeState string
+
+const (
+	NodeStateAlive    NodeState = "alive"
+	NodeStateDraining NodeState = "draining"
+)
+
+// A Node is a member of the ring. The ID is the key the node is stored under
+// in the ring, and is what GetNode and friends return, e.g. "10.0.0.1:8000".
+// The rest is what the backend knows about it. The Weight, Location and State
+// always reflect the ring as of the snapshot the Node came from.
+type Node struct {
+	ID       string
+	Name     string // The backend's name for it, e.g. the Memberlist node name
+	Address  string
+	Port     int
+	Weight   int
+	Location Location
+	Metadata map[string]string `json:",omitempty"`
+	State    NodeState
+}
+
+// nodeFromID returns a Node for a bare node name, taking the address and
+// port from it if it looks like host:port.
+func nodeFromID(id string) Node {
+	node := Node{ID: id, Name: id, Address: id}
+
+	host, portStr, err := net.SplitHostPort(id)
+	if err != nil {
+		return node
+	}
+
+	if port, err := strconv.Atoi(portStr); err == nil {
+		node.Address = host
+		node.Port = port
+	}
+
+	return node
+}
+
+// sameInfo reports whether the two Nodes carry the same information from the
+// backend. The ring's own view of the node is ignored.
+func (n *Node) sameInfo(other *Node) bool {
+	if n.Name != other.Name || n.Address != other.Address || n.Port != other.Port ||
+		len(n.Metadata) != len(other.Metadata) {
+		return false
+	}
+
+	for k, v := range n.Metadata {
+		if otherV, ok := other.Metadata[k]; !ok || otherV != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// copyMetadata returns a copy of the metadata, so callers can't change ours.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+
+	return copied
+}
+
+// AddNodeInfo is a blocking call that adds the Node to the ring under its ID,
+// or updates it if it is already there, and waits for it to be applied. The
+// Node is kept alongside the ring and returned from GetNodeInfo and friends.
+// If its State is set, the node is drained or resumed to match, in the same
+// change. An empty State leaves it as it is.
+func (r *HashRingManager) AddNodeInfo(node Node) error {
+	return r.AddNodeInfoContext(context.Background(), node)
+}
+
+// AddNodeInfoContext is like AddNodeInfo but gives up when the context is
+// done.
+func (r *HashRingManager) AddNodeInfoContext(ctx context.Context, node Node) error {
+	node.Metadata = copyMetadata(node.Metadata)
+
+	return r.sendChange(ctx, RingCommand{
+		Command:  CmdAddNode,
+		NodeName: node.ID,
+		Weight:   node.Weight,
+		Location: &node.Location,
+		Info:     &node,
+	})
+}
+
+// SetNodesInfo is like SetNodes, but keeps each Node alongside the ring, like
+// AddNodeInfo does.
+func (r *HashRingManager) SetNodesInfo(nodes []Node) error {
+	return r.SetNodesInfoContext(context.Background(), nodes)
+}
+
+// SetNodesInfoContext is like SetNodesInfo but gives up when the context is
+// done.
+func (r *HashRingManager) SetNodesInfoContext(ctx context.Context, nodes []Node) error {
+	weights, infos := nodesByID(nodes)
+
+	return r.sendChange(ctx, RingCommand{Command: CmdSetNodes, Nodes: weights, Infos: infos})
+}
+
+// ApplyDiffInfo is like ApplyDiff, but keeps each Node alongside the ring,
+// like AddNodeInfo does.
+func (r *HashRingManager) ApplyDiffInfo(add []Node, remove []string) error {
+	return r.ApplyDiffInfoContext(context.Background(), add, remove)
+}
+
+// ApplyDiffInfoContext is like ApplyDiffInfo but gives up when the context is
+// done.
+func (r *HashRingManager) ApplyDiffInfoContext(ctx context.Context, add []Node, remove []string) error {
+	weights, infos := nodesByID(add)
+
+	return r.sendChange(ctx, RingCommand{
+		Command: CmdApplyDiff,
+		Nodes:   weights,
+		Infos:   infos,
+		Remove:  append([]string(nil), remove...),
+	})
+}
+
+// nodesByID returns the weight and a copy of each of the Nodes, by ID.
+func nodesByID(nodes []Node) (map[string]int, map[string]Node) {
+	weights := make(map[string]int, len(nodes))
+	infos := make(map[string]Node, len(nodes))
+	for _, node := range nodes {
+		node.Metadata = copyMetadata(node.Metadata)
+		weights[node.ID] = node.Weight
+		infos[node.ID] = node
+	}
+
+	return weights, infos
+}
+
+// GetNodeInfo returns the Node that owns the key.
+func (r *HashRingManager) GetNodeInfo(key string) (Node, error) {
+	snap, err := r.Snapshot()
+	if err != nil {
+		return Node{}, err
+	}
+
+	id, err := r.nodeFromSnapshot(snap, key)
+	if err != nil {
+		return Node{}, err
+	}
+
+	node, _ := snap.Node(id)
+	return node, nil
+}
+
+// GetNodesInfo returns up to count Nodes for the key, in the same order as
+// GetNodes. The first is the one GetNodeInfo returns.
+func (r *HashRingManager) GetNodesInfo(key string, count int) ([]Node, error) {
+	if count < 1 {
+		return nil, ErrBadCount
+	}
+
+	snap, err := r.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := r.nodesFromSnapshot(snap, key, count)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Node, 0, len(ids))
+	for _, id := range ids {
+		node, _ := snap.Node(id)
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// ListNodes returns every Node in the ring, draining or not, sorted by ID.
+func (r *HashRingManager) ListNodes() ([]Node, error) {
+	snap, err := r.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return snap.Nodes(), nil
+}
+
+// Node returns the Node with the ID, as of this version of the ring.
+func (s *RingSnapshot) Node(id string) (Node, bool) {
+	node, ok := s.nodes[id]
+	node.Metadata = copyMetadata(node.Metadata)
+	return node, ok
+}
+
+// Nodes returns every Node in this version of the ring, sorted by ID.
+func (s *RingSnapshot) Nodes() []Node {
+	nodes := make([]Node, 0, len(s.nodes))
+	for id := range s.nodes {
+		node, _ := s.Node(id)
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	return nodes
+}
+
+// nodeInfos returns a Node for each node in the ring, as of now. It must only
+// be called from the Run loop.
+func (r *HashRingManager) nodeInfos() map[string]Node {
+	nodes := make(map[string]Node, len(r.weights))
+	for id, weight := range r.weights {
+		node, ok := r.infos[id]
+		if !ok {
+			node = nodeFromID(id)
+		}
+
+		node.ID = id
+		node.Weight = weight
+		node.Location = r.locations[id]
+		node.State = NodeStateAlive
+		if r.draining[id] {
+			node.State = NodeStateDraining
+		}
+
+		nodes[id] = node
+	}
+
+	return nodes
+}
+
+// httpListNodes writes the JSON-encoded list of the Nodes in the manager's
+// ring. It is what /nodes serves, whatever the backend.
+func httpListNodes(w http.ResponseWriter, manager *HashRingManager) {
+	nodes, err := manager.ListNodes()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
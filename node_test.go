@@ -0,0 +1,191 @@
+package ringman
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_NodeInfo(t *testing.T) {
+	Convey("Node info", t, func() {
+		ringMgr := NewHashRingManager([]string{"10.0.0.2:8000"})
+		go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+
+		info := Node{
+			ID:       "10.0.0.1:8000",
+			Name:     "node-1",
+			Address:  "10.0.0.1",
+			Port:     8000,
+			Weight:   3,
+			Location: Location{Zone: "us-east-1a"},
+			Metadata: map[string]string{"version": "1.2.3"},
+		}
+
+		Convey("makes up a Node for nodes added without one", func() {
+			snap, err := ringMgr.Snapshot()
+			So(err, ShouldBeNil)
+
+			found, exists := snap.Node("10.0.0.2:8000")
+			So(exists, ShouldBeTrue)
+			So(found, ShouldResemble, Node{
+				ID: "10.0.0.2:8000", Name: "10.0.0.2:8000", Address: "10.0.0.2", Port: 8000,
+				Weight: DefaultNodeWeight, State: NodeStateAlive,
+			})
+
+			So(nodeFromID("some-host").Address, ShouldEqual, "some-host")
+			So(nodeFromID("some-host").Port, ShouldEqual, 0)
+		})
+
+		Convey("keeps the Node alongside the ring", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Weights()["10.0.0.1:8000"], ShouldEqual, 3)
+			So(snap.Location("10.0.0.1:8000").Zone, ShouldEqual, "us-east-1a")
+
+			expected := info
+			expected.State = NodeStateAlive
+
+			found, ok := snap.Node("10.0.0.1:8000")
+			So(ok, ShouldBeTrue)
+			So(found, ShouldResemble, expected)
+		})
+
+		Convey("returns the Node from lookups", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+
+			owner, _ := ringMgr.GetNode("bocaccio")
+			node, err := ringMgr.GetNodeInfo("bocaccio")
+			So(err, ShouldBeNil)
+			So(node.ID, ShouldEqual, owner)
+
+			nodes, err := ringMgr.GetNodesInfo("bocaccio", 2)
+			So(err, ShouldBeNil)
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, owner)
+
+			_, err = ringMgr.GetNodesInfo("bocaccio", 0)
+			So(err, ShouldEqual, ErrBadCount)
+		})
+
+		Convey("reports the State of draining nodes", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			So(ringMgr.SetDraining("10.0.0.1:8000", true), ShouldBeNil)
+
+			nodes, err := ringMgr.ListNodes()
+			So(err, ShouldBeNil)
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+			So(nodes[0].State, ShouldEqual, NodeStateDraining)
+			So(nodes[1].State, ShouldEqual, NodeStateAlive)
+		})
+
+		Convey("only changes the version when the Node changes", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			version := ringMgr.Version()
+
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			So(ringMgr.Version(), ShouldEqual, version)
+
+			info.Metadata = map[string]string{"version": "1.2.4"}
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			So(ringMgr.Version(), ShouldEqual, version+1)
+
+			snap, _ := ringMgr.Snapshot()
+			found, _ := snap.Node(info.ID)
+			So(found.Metadata["version"], ShouldEqual, "1.2.4")
+		})
+
+		Convey("doesn't let callers change the Metadata", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			info.Metadata["version"] = "changed"
+
+			snap, _ := ringMgr.Snapshot()
+			found, _ := snap.Node("10.0.0.1:8000")
+			So(found.Metadata["version"], ShouldEqual, "1.2.3")
+
+			found.Metadata["version"] = "changed"
+			found, _ = snap.Node("10.0.0.1:8000")
+			So(found.Metadata["version"], ShouldEqual, "1.2.3")
+		})
+
+		Convey("replaces all the Nodes at once with SetNodesInfo()", func() {
+			other := Node{ID: "10.0.0.3:8000", Name: "node-3", Address: "10.0.0.3", Port: 8000}
+			So(ringMgr.SetNodesInfo([]Node{info, other}), ShouldBeNil)
+
+			nodes, _ := ringMgr.ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].Name, ShouldEqual, "node-1")
+			So(nodes[1].Name, ShouldEqual, "node-3")
+			So(nodes[1].Weight, ShouldEqual, DefaultNodeWeight)
+			So(ringMgr.Version(), ShouldEqual, 1)
+		})
+
+		Convey("drains and resumes a Node from its State in a single change", func() {
+			info.State = NodeStateDraining
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			So(ringMgr.Version(), ShouldEqual, 1)
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.IsDraining("10.0.0.1:8000"), ShouldBeTrue)
+
+			info.State = NodeStateAlive
+			So(ringMgr.SetNodesInfo([]Node{info}), ShouldBeNil)
+			So(ringMgr.Version(), ShouldEqual, 2)
+
+			snap, _ = ringMgr.Snapshot()
+			So(snap.IsDraining("10.0.0.1:8000"), ShouldBeFalse)
+		})
+
+		Convey("leaves draining alone when the State is empty", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			So(ringMgr.SetDraining("10.0.0.1:8000", true), ShouldBeNil)
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.IsDraining("10.0.0.1:8000"), ShouldBeTrue)
+		})
+
+		Convey("applies a diff of Nodes at once with ApplyDiffInfo()", func() {
+			info.State = NodeStateDraining
+			So(ringMgr.ApplyDiffInfo([]Node{info}, []string{"10.0.0.2:8000"}), ShouldBeNil)
+			So(ringMgr.Version(), ShouldEqual, 1)
+
+			nodes, _ := ringMgr.ListNodes()
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].Name, ShouldEqual, "node-1")
+			So(nodes[0].State, ShouldEqual, NodeStateDraining)
+		})
+
+		Convey("forgets the Node when it is removed", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+			So(ringMgr.RemoveNode("10.0.0.1:8000"), ShouldBeNil)
+			So(ringMgr.AddNode("10.0.0.1:8000"), ShouldBeNil)
+
+			snap, _ := ringMgr.Snapshot()
+			found, _ := snap.Node("10.0.0.1:8000")
+			So(found.Name, ShouldEqual, "10.0.0.1:8000")
+			So(found.Metadata, ShouldBeNil)
+		})
+
+		Convey("lists the Nodes over HTTP", func() {
+			So(ringMgr.AddNodeInfo(info), ShouldBeNil)
+
+			recorder := httptest.NewRecorder()
+			httpListNodes(recorder, ringMgr)
+
+			var nodes []Node
+			So(json.Unmarshal(recorder.Body.Bytes(), &nodes), ShouldBeNil)
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].Name, ShouldEqual, "node-1")
+			So(nodes[0].Metadata["version"], ShouldEqual, "1.2.3")
+		})
+
+		Reset(func() {
+			ringMgr.Stop()
+		})
+	})
+}
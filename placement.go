@@ -0,0 +1,147 @@
+package ringman
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/serialx/hashring"
+)
+
+const (
+	// MaxPlacementWeight is the most weight the jump and Maglev placements
+	// give any one node. Weights are advertised by the nodes themselves, and
+	// those placements grow with them, so one node advertising a huge weight
+	// could otherwise make every member build a huge placement.
+	MaxPlacementWeight = 1000
+)
+
+// A Placement decides which nodes own a key. Placements are immutable: the
+// HashRingManager builds a new one each time the membership changes, so that
+// snapshots already handed out are never affected.
+type Placement interface {
+	// GetNode returns the node that owns the key. It returns false when
+	// there are no nodes.
+	GetNode(key string) (string, bool)
+
+	// GetNodes returns up to count distinct nodes for the key, starting
+	// with the node that owns it. It returns false when there are no nodes.
+	GetNodes(key string, count int) ([]string, bool)
+}
+
+// A PlacementFunc builds a Placement for the nodes and weights provided. It
+// must not hold on to the map it is given. The same nodes and weights must
+// always produce the same Placement, so that every member of the cluster
+// agrees on who owns what.
+type PlacementFunc func(weights map[string]int) Placement
+
+// hashringPlacement is the default Placement, a consistent hash ring backed
+// by serialx/hashring.
+type hashringPlacement struct {
+	ring   *hashring.HashRing
+	tokens []ringToken // The ring's points, sorted by token
+}
+
+// ringToken is a single point on the ring and the node that owns the tokens
+// leading up to it.
+type ringToken struct {
+	token uint32
+	node  string
+}
+
+// NewHashringPlacement is a PlacementFunc for a consistent hash ring backed
+// by serialx/hashring. This is the default.
+func NewHashringPlacement(weights map[string]int) Placement {
+	// The hashring holds on to the map it is given, so it gets its own,
+	// without the nodes that have no weight
+	ringWeights := make(map[string]int, len(weights))
+	for _, node := range weightedNodes(weights) {
+		ringWeights[node] = weights[node]
+	}
+
+	return &hashringPlacement{
+		ring:   hashring.NewWithWeights(ringWeights),
+		tokens: ringTokens(ringWeights),
+	}
+}
+
+// ringTokens returns the points serialx/hashring puts on its circle for the
+// weights, sorted by token. The library doesn't expose them, so this mirrors
+// its layout: each node gets a share of 40 points per node in the ring in
+// proportion to its weight, and each point yields three tokens from the MD5
+// of "node-index".
+func ringTokens(weights map[string]int) []ringToken {
+	totalWeight := 0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+
+	var tokens []ringToken
+	for node, weight := range weights {
+		factor := math.Floor(float64(40*len(weights)*weight) / float64(totalWeight))
+
+		for j := 0; j < int(factor); j++ {
+			digest := md5.Sum([]byte(node + "-" + strconv.Itoa(j)))
+			for i := 0; i < 3; i++ {
+				tokens = append(tokens, ringToken{
+					token: binary.LittleEndian.Uint32(digest[i*4 : i*4+4]),
+					node:  node,
+				})
+			}
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].token < tokens[j].token })
+
+	return tokens
+}
+
+func (p *hashringPlacement) GetNode(key string) (string, bool) {
+	return p.ring.GetNode(key)
+}
+
+func (p *hashringPlacement) GetNodes(key string, count int) ([]string, bool) {
+	// The hashring refuses to return anything when asked for more
+	// nodes than it has, so we cap the count at the ring size.
+	if count > p.ring.Size() {
+		count = p.ring.Size()
+	}
+
+	nodes, ok := p.ring.GetNodes(key, count)
+	if !ok || len(nodes) == 0 {
+		return nil, false
+	}
+
+	return nodes, true
+}
+
+// cappedWeight returns the weight, but no more than MaxPlacementWeight.
+func cappedWeight(weight int) int {
+	if weight > MaxPlacementWeight {
+		return MaxPlacementWeight
+	}
+
+	return weight
+}
+
+// hash64 returns a well-mixed 64-bit hash of the strings provided. It's
+// FNV-1a with the MurmurHash3 finalizer on the end, since FNV alone doesn't
+// spread out keys that differ only in their last few bytes.
+func hash64(parts ...string) uint64 {
+	hasher := fnv.New64a()
+	for _, part := range parts {
+		hasher.Write([]byte(part))
+	}
+
+	h := hasher.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
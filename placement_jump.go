@@ -0,0 +1,79 @@
+package ringman
+
+// jumpPlacement implements Lamping and Veach's Jump consistent hash. It needs
+// no memory beyond the list of buckets and spreads keys very evenly, but it
+// can only add or remove buckets at the end of the list without disruption.
+// Nodes are kept in sorted order, so nodes whose names sort last can come and
+// go cheaply, while a node joining or leaving in the middle reshuffles the
+// keys of every node after it. Weights are honored by giving a node one
+// bucket per unit of weight, up to MaxPlacementWeight.
+type jumpPlacement struct {
+	buckets []string
+	nodes   int
+}
+
+// NewJumpPlacement is a PlacementFunc for Jump consistent hashing.
+func NewJumpPlacement(weights map[string]int) Placement {
+	p := &jumpPlacement{}
+	for _, node := range weightedNodes(weights) {
+		for i := 0; i < cappedWeight(weights[node]); i++ {
+			p.buckets = append(p.buckets, node)
+		}
+		p.nodes++
+	}
+
+	return p
+}
+
+// jumpHash returns the bucket for the key, out of numBuckets. This is the
+// algorithm straight from "A Fast, Minimal Memory, Consistent Hash Algorithm".
+func jumpHash(key uint64, numBuckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+func (p *jumpPlacement) GetNode(key string) (string, bool) {
+	if len(p.buckets) == 0 {
+		return "", false
+	}
+
+	return p.buckets[jumpHash(hash64(key), len(p.buckets))], true
+}
+
+// GetNodes starts from the key's bucket and takes the following buckets in
+// order, skipping nodes we already have.
+func (p *jumpPlacement) GetNodes(key string, count int) ([]string, bool) {
+	if len(p.buckets) == 0 {
+		return nil, false
+	}
+
+	if count > p.nodes {
+		count = p.nodes
+	}
+
+	return walkDistinct(p.buckets, jumpHash(hash64(key), len(p.buckets)), count), true
+}
+
+// walkDistinct walks the slots from start, wrapping around, and returns the
+// first count distinct nodes it finds.
+func walkDistinct(slots []string, start int, count int) []string {
+	seen := make(map[string]struct{}, count)
+	nodes := make([]string, 0, count)
+
+	for i := 0; i < len(slots) && len(nodes) < count; i++ {
+		node := slots[(start+i)%len(slots)]
+		if _, ok := seen[node]; ok {
+			continue
+		}
+		seen[node] = struct{}{}
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
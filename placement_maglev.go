@@ -0,0 +1,134 @@
+package ringman
+
+import (
+	"sort"
+)
+
+const (
+	// MaglevTableSize is the size of the Maglev lookup table. It must be
+	// prime, and should be well over 100 times the number of nodes in the
+	// ring for an even spread.
+	MaglevTableSize = 65537
+)
+
+// maglevPlacement implements the consistent hashing from Google's Maglev
+// load balancer. Each node fills slots in a lookup table following its own
+// permutation, which gives a near perfectly even spread and constant time
+// lookups, at the cost of rebuilding the table on each change. Disruption is
+// close to, but not quite, the minimum. Weights, up to MaxPlacementWeight,
+// are honored by giving each node a share of the table in proportion to its
+// weight. The nodes take turns claiming one slot at a time until they have
+// their share, so none of them is favored when the table runs out.
+type maglevPlacement struct {
+	table []string
+	nodes int
+}
+
+// NewMaglevPlacement is a PlacementFunc for Maglev hashing.
+func NewMaglevPlacement(weights map[string]int) Placement {
+	nodes := weightedNodes(weights)
+	p := &maglevPlacement{nodes: len(nodes)}
+	if len(nodes) == 0 {
+		return p
+	}
+
+	size := uint64(MaglevTableSize)
+	offsets := make([]uint64, len(nodes))
+	skips := make([]uint64, len(nodes))
+	next := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		offsets[i] = hash64(node, "\x00offset") % size
+		skips[i] = hash64(node, "\x00skip")%(size-1) + 1
+	}
+
+	p.table = make([]string, size)
+
+	// Take turns until every node has its share, dropping each one once it
+	// has. The shares add up to the size of the table, so that fills it.
+	quotas := maglevQuotas(nodes, weights, size)
+	turns := make([]int, 0, len(nodes))
+	for i := range nodes {
+		if quotas[i] > 0 {
+			turns = append(turns, i)
+		}
+	}
+
+	for len(turns) > 0 {
+		remaining := turns[:0]
+		for _, i := range turns {
+			// Find this node's next preferred slot that is still free
+			slot := (offsets[i] + next[i]*skips[i]) % size
+			for p.table[slot] != "" {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % size
+			}
+
+			p.table[slot] = nodes[i]
+			next[i]++
+
+			quotas[i]--
+			if quotas[i] > 0 {
+				remaining = append(remaining, i)
+			}
+		}
+		turns = remaining
+	}
+
+	return p
+}
+
+// maglevQuotas returns how many slots of the table each of the nodes gets, in
+// proportion to its capped weight. The slots left over from rounding down go
+// to the nodes with the largest remainders, and then to those that sort
+// first.
+func maglevQuotas(nodes []string, weights map[string]int, size uint64) []uint64 {
+	totalWeight := uint64(0)
+	for _, node := range nodes {
+		totalWeight += uint64(cappedWeight(weights[node]))
+	}
+
+	quotas := make([]uint64, len(nodes))
+	remainders := make([]uint64, len(nodes))
+	assigned := uint64(0)
+	for i, node := range nodes {
+		share := size * uint64(cappedWeight(weights[node]))
+		quotas[i] = share / totalWeight
+		remainders[i] = share % totalWeight
+		assigned += quotas[i]
+	}
+
+	order := make([]int, len(nodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+
+	for _, i := range order[:size-assigned] {
+		quotas[i]++
+	}
+
+	return quotas
+}
+
+func (p *maglevPlacement) GetNode(key string) (string, bool) {
+	if len(p.table) == 0 {
+		return "", false
+	}
+
+	return p.table[hash64(key)%uint64(len(p.table))], true
+}
+
+// GetNodes starts from the key's slot and takes the following slots in
+// order, skipping nodes we already have.
+func (p *maglevPlacement) GetNodes(key string, count int) ([]string, bool) {
+	if len(p.table) == 0 {
+		return nil, false
+	}
+
+	if count > p.nodes {
+		count = p.nodes
+	}
+
+	start := int(hash64(key) % uint64(len(p.table)))
+	return walkDistinct(p.table, start, count), true
+}
@@ -0,0 +1,104 @@
+package ringman
+
+import (
+	"math"
+	"sort"
+)
+
+// rendezvousPlacement implements weighted rendezvous, or highest random
+// weight (HRW), hashing. Every node scores every key and the highest score
+// wins. When a node leaves, only the keys it owned move, and they are spread
+// evenly over the remaining nodes. Lookups cost O(n) in the number of nodes.
+type rendezvousPlacement struct {
+	nodes   []string
+	weights []float64
+}
+
+// NewRendezvousPlacement is a PlacementFunc for rendezvous (HRW) hashing.
+func NewRendezvousPlacement(weights map[string]int) Placement {
+	p := &rendezvousPlacement{}
+	for _, node := range weightedNodes(weights) {
+		p.nodes = append(p.nodes, node)
+		p.weights = append(p.weights, float64(weights[node]))
+	}
+
+	return p
+}
+
+// score is the weighted score for a node and key: -weight / ln(h) with h
+// uniform in (0, 1). This gives each node a share of the keys proportional
+// to its weight.
+func (p *rendezvousPlacement) score(i int, key string) float64 {
+	h := hash64(p.nodes[i], "\x00", key)
+	unit := (float64(h>>11) + 0.5) / (1 << 53)
+
+	return -p.weights[i] / math.Log(unit)
+}
+
+func (p *rendezvousPlacement) GetNode(key string) (string, bool) {
+	if len(p.nodes) == 0 {
+		return "", false
+	}
+
+	best := 0
+	bestScore := p.score(0, key)
+	for i := 1; i < len(p.nodes); i++ {
+		if score := p.score(i, key); score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+
+	return p.nodes[best], true
+}
+
+func (p *rendezvousPlacement) GetNodes(key string, count int) ([]string, bool) {
+	if len(p.nodes) == 0 {
+		return nil, false
+	}
+
+	scores := make([]float64, len(p.nodes))
+	order := make([]int, len(p.nodes))
+	for i := range p.nodes {
+		scores[i] = p.score(i, key)
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	if count > len(order) {
+		count = len(order)
+	}
+
+	nodes := make([]string, 0, count)
+	for _, i := range order[:count] {
+		nodes = append(nodes, p.nodes[i])
+	}
+
+	return nodes, true
+}
+
+// sortedNodes returns the nodes in the weights map in sorted order, which
+// gives every member of the cluster the same view regardless of the order in
+// which they saw nodes arrive.
+func sortedNodes(weights map[string]int) []string {
+	nodes := make([]string, 0, len(weights))
+	for node := range weights {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// weightedNodes is sortedNodes without the nodes whose weight is zero or less,
+// which would otherwise take no keys but still count as members.
+func weightedNodes(weights map[string]int) []string {
+	nodes := make([]string, 0, len(weights))
+	for _, node := range sortedNodes(weights) {
+		if weights[node] > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
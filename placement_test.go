@@ -0,0 +1,281 @@
+package ringman
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var allPlacements = map[string]PlacementFunc{
+	"hashring":   NewHashringPlacement,
+	"rendezvous": NewRendezvousPlacement,
+	"jump":       NewJumpPlacement,
+	"maglev":     NewMaglevPlacement,
+}
+
+// placementNodes returns count equally weighted nodes whose names sort in
+// the order they were created.
+func placementNodes(count int) map[string]int {
+	weights := make(map[string]int, count)
+	for i := 0; i < count; i++ {
+		weights[fmt.Sprintf("node-%02d", i)] = 1
+	}
+
+	return weights
+}
+
+func placementKeys(count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	return keys
+}
+
+// maxDeviation returns how far the busiest or idlest node is from an even
+// share of the keys, as a fraction of that share.
+func maxDeviation(placement Placement, nodes map[string]int, keys []string) float64 {
+	counts := make(map[string]int, len(nodes))
+	for _, key := range keys {
+		node, _ := placement.GetNode(key)
+		counts[node]++
+	}
+
+	even := float64(len(keys)) / float64(len(nodes))
+	worst := 0.0
+	for node := range nodes {
+		worst = math.Max(worst, math.Abs(float64(counts[node])-even)/even)
+	}
+
+	return worst
+}
+
+// movedFraction returns the fraction of keys whose owner is different
+// between the two placements.
+func movedFraction(before Placement, after Placement, keys []string) float64 {
+	moved := 0
+	for _, key := range keys {
+		oldNode, _ := before.GetNode(key)
+		newNode, _ := after.GetNode(key)
+		if oldNode != newNode {
+			moved++
+		}
+	}
+
+	return float64(moved) / float64(len(keys))
+}
+
+func Test_PlacementDistribution(t *testing.T) {
+	Convey("Placements spread keys over the same nodes", t, func() {
+		nodes := placementNodes(10)
+		keys := placementKeys(20000)
+
+		// The hashring only has 120 points per node, so it is the lumpiest
+		limits := map[string]float64{
+			"hashring":   0.3,
+			"rendezvous": 0.1,
+			"jump":       0.1,
+			"maglev":     0.1,
+		}
+
+		for name, placementFn := range allPlacements {
+			deviation := maxDeviation(placementFn(nodes), nodes, keys)
+
+			Convey(fmt.Sprintf("%s stays within %.0f%% of an even share", name, limits[name]*100), func() {
+				So(deviation, ShouldBeLessThan, limits[name])
+			})
+		}
+	})
+
+	Convey("Placements honor weights", t, func() {
+		nodes := map[string]int{"light": 1, "heavy": 4}
+		keys := placementKeys(20000)
+
+		for name, placementFn := range allPlacements {
+			placement := placementFn(nodes)
+
+			counts := make(map[string]int)
+			for _, key := range keys {
+				node, _ := placement.GetNode(key)
+				counts[node]++
+			}
+
+			Convey(fmt.Sprintf("%s gives the heavy node about four times the keys", name), func() {
+				ratio := float64(counts["heavy"]) / float64(counts["light"])
+				So(ratio, ShouldBeBetween, 3.0, 5.0)
+			})
+		}
+	})
+}
+
+func Test_PlacementDisruption(t *testing.T) {
+	Convey("Placements move few keys when membership changes", t, func() {
+		nodes := placementNodes(10)
+		keys := placementKeys(20000)
+
+		// The eleventh node sorts last, which is the best case for jump
+		grown := placementNodes(11)
+		// Removing a node from the middle is the worst case for jump
+		shrunk := placementNodes(10)
+		delete(shrunk, "node-04")
+
+		for name, placementFn := range allPlacements {
+			before := placementFn(nodes)
+			added := movedFraction(before, placementFn(grown), keys)
+			removed := movedFraction(before, placementFn(shrunk), keys)
+
+			Convey(fmt.Sprintf("%s moves about 1/11th of the keys to a new node", name), func() {
+				So(added, ShouldBeLessThan, 0.15)
+			})
+
+			if name == "jump" {
+				Convey("jump moves many keys when a node leaves from the middle", func() {
+					So(removed, ShouldBeGreaterThan, 0.3)
+				})
+				continue
+			}
+
+			Convey(fmt.Sprintf("%s moves about 1/10th of the keys off a departed node", name), func() {
+				So(removed, ShouldBeLessThan, 0.15)
+			})
+		}
+	})
+}
+
+func Test_PlacementGetNodes(t *testing.T) {
+	Convey("Placements return distinct replicas", t, func() {
+		nodes := placementNodes(5)
+
+		for name, placementFn := range allPlacements {
+			placement := placementFn(nodes)
+
+			Convey(fmt.Sprintf("%s starts with the owner and caps at the ring size", name), func() {
+				for _, key := range placementKeys(100) {
+					owner, ok := placement.GetNode(key)
+					So(ok, ShouldBeTrue)
+
+					replicas, ok := placement.GetNodes(key, 3)
+					So(ok, ShouldBeTrue)
+					So(len(replicas), ShouldEqual, 3)
+					So(replicas[0], ShouldEqual, owner)
+					So(replicas[1], ShouldNotEqual, replicas[0])
+					So(replicas[2], ShouldNotEqual, replicas[1])
+					So(replicas[2], ShouldNotEqual, replicas[0])
+
+					all, _ := placement.GetNodes(key, 10)
+					So(len(all), ShouldEqual, 5)
+				}
+			})
+
+			Convey(fmt.Sprintf("%s handles having no nodes", name), func() {
+				empty := placementFn(map[string]int{})
+
+				_, ok := empty.GetNode("foo")
+				So(ok, ShouldBeFalse)
+
+				_, ok = empty.GetNodes("foo", 2)
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey(fmt.Sprintf("%s leaves out nodes without weight", name), func() {
+				weighted := placementFn(map[string]int{"njal": 0, "gunnar": -1, "kjartan": 1})
+
+				for _, key := range placementKeys(100) {
+					nodes, ok := weighted.GetNodes(key, 3)
+					So(ok, ShouldBeTrue)
+					So(nodes, ShouldResemble, []string{"kjartan"})
+				}
+
+				unweighted := placementFn(map[string]int{"njal": 0, "gunnar": -1})
+
+				_, ok := unweighted.GetNode("foo")
+				So(ok, ShouldBeFalse)
+
+				_, ok = unweighted.GetNodes("foo", 2)
+				So(ok, ShouldBeFalse)
+			})
+		}
+	})
+}
+
+func Test_PlacementWeightCap(t *testing.T) {
+	Convey("Placements that grow with weight cap it", t, func() {
+		weights := map[string]int{"njal": 2000000000, "gunnar": 1}
+
+		Convey("jump gives a node no more than MaxPlacementWeight buckets", func() {
+			jump := NewJumpPlacement(weights).(*jumpPlacement)
+			So(len(jump.buckets), ShouldEqual, MaxPlacementWeight+1)
+		})
+
+		Convey("Maglev gives a light node its share next to a capped one", func() {
+			maglev := NewMaglevPlacement(weights).(*maglevPlacement)
+
+			slots := 0
+			for _, node := range maglev.table {
+				if node == "gunnar" {
+					slots++
+				}
+			}
+			So(slots, ShouldAlmostEqual, MaglevTableSize/(MaxPlacementWeight+1), 1)
+		})
+
+		Convey("Maglev shares out slots by weight when the weights add up to more than the table", func() {
+			heavy := make(map[string]int, 100)
+			for i := 0; i < 100; i++ {
+				heavy[fmt.Sprintf("node-%02d", i)] = 400 * (1 + i%2)
+			}
+			maglev := NewMaglevPlacement(heavy).(*maglevPlacement)
+
+			slots := make(map[string]int, len(heavy))
+			for _, node := range maglev.table {
+				slots[node]++
+			}
+
+			// The weights add up to 60000, so each unit is worth a slot or so
+			for node, weight := range heavy {
+				share := float64(MaglevTableSize) * float64(weight) / 60000
+				So(slots[node], ShouldAlmostEqual, share, 1)
+			}
+		})
+	})
+}
+
+func Test_SetPlacement(t *testing.T) {
+	Convey("HashRingManager placement", t, func() {
+		Convey("can be chosen at construction", func() {
+			nodes := placementNodes(3)
+			ringMgr := NewHashRingManagerWithPlacement(nodes, NewRendezvousPlacement)
+			So(ringMgr.HashRing, ShouldBeNil)
+
+			expected, _ := NewRendezvousPlacement(nodes).GetNode("foo")
+			node, err := ringMgr.GetNode("foo")
+			So(err, ShouldBeNil)
+			So(node, ShouldEqual, expected)
+		})
+
+		Convey("can be changed while running", func() {
+			ringMgr := NewHashRingManager([]string{"njal", "kjartan"})
+			go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+			So(ringMgr.Ping(), ShouldBeTrue)
+
+			events := make(chan RingEvent, 1)
+			ringMgr.Subscribe(events)
+
+			So(ringMgr.SetPlacement(nil), ShouldNotBeNil)
+			So(ringMgr.SetPlacement(NewMaglevPlacement), ShouldBeNil)
+			So(ringMgr.HashRing, ShouldBeNil)
+			So((<-events).Type, ShouldEqual, PlacementChanged)
+
+			expected, _ := NewMaglevPlacement(map[string]int{"njal": 1, "kjartan": 1}).GetNode("foo")
+			node, err := ringMgr.GetNode("foo")
+			So(err, ShouldBeNil)
+			So(node, ShouldEqual, expected)
+
+			ringMgr.Stop()
+		})
+	})
+}
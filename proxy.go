@@ -0,0 +1,326 @@
+package ringman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+const (
+	// ForwardedByHeader is set on requests the Proxy forwards, to the name
+	// of the node that forwarded them. A request that arrives with it from
+	// that node is always served locally, so it can't bounce around the
+	// cluster while the nodes disagree about the ring. From anywhere else,
+	// the header is removed and ignored.
+	ForwardedByHeader = "X-Ringman-Forwarded-By"
+
+	DefaultProxyAttempts = 3                // The owner, and then two more replicas
+	MaxProxyBodySize     = 10 * 1024 * 1024 // The most we'll buffer so a request can be retried
+)
+
+// A KeyExtractor returns the ring key for an incoming request.
+type KeyExtractor func(req *http.Request) (string, error)
+
+// KeyFromHeader returns a KeyExtractor that takes the key from a header.
+func KeyFromHeader(name string) KeyExtractor {
+	return func(req *http.Request) (string, error) {
+		key := req.Header.Get(name)
+		if key == "" {
+			return "", fmt.Errorf("No %s header in request!", name)
+		}
+
+		return key, nil
+	}
+}
+
+// KeyFromQuery returns a KeyExtractor that takes the key from a query
+// parameter.
+func KeyFromQuery(param string) KeyExtractor {
+	return func(req *http.Request) (string, error) {
+		key := req.URL.Query().Get(param)
+		if key == "" {
+			return "", fmt.Errorf("No %s parameter in request!", param)
+		}
+
+		return key, nil
+	}
+}
+
+// KeyFromPathSegment returns a KeyExtractor that takes the key from a
+// segment of the URL path, counting from zero. For /users/1234/profile,
+// segment 1 is 1234.
+func KeyFromPathSegment(index int) KeyExtractor {
+	return func(req *http.Request) (string, error) {
+		segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if index < 0 || index >= len(segments) || segments[index] == "" {
+			return "", fmt.Errorf("No path segment %d in request!", index)
+		}
+
+		return segments[index], nil
+	}
+}
+
+// A Proxy is middleware that sends each request to the node that owns its
+// key. Requests owned by the local node are passed on to the next handler,
+// and the rest are reverse proxied to their owner. If the owner can't be
+// reached, the next replica is tried, up to Attempts nodes in all. Requests
+// that aren't safe to send twice, like a POST, are only sent on to the next
+// replica if the connection to the owner couldn't be made at all.
+//
+// Node names are expected to be the host:port the node serves HTTP on, as
+// they are for the MemberlistRing and the SidecarRing. The ring's LocalNode
+// is looked up on each request, so it may change while the Proxy runs. Until
+// the ring knows its LocalNode, requests that weren't forwarded by another
+// node get a 503, since we can't tell which of them are ours.
+type Proxy struct {
+	Ring  Ring
+	KeyFn KeyExtractor
+
+	Attempts  int               // How many replicas to try, DefaultProxyAttempts if < 1
+	Scheme    string            // Used to reach other nodes, "http" if empty
+	Transport http.RoundTripper // http.DefaultTransport if nil
+
+	logger loggerRef
+}
+
+// NewProxy returns a Proxy for the ring.
+func NewProxy(ring Ring, keyFn KeyExtractor) *Proxy {
+	return &Proxy{
+		Ring:  ring,
+		KeyFn: keyFn,
+	}
+}
+
+// SetLogger sets the Logger the Proxy writes to. Until it is called, the
+// default Logger is used.
+func (p *Proxy) SetLogger(logger Logger) {
+	p.logger.set(logger)
+}
+
+// Handler wraps next, which serves the requests owned by this node.
+func (p *Proxy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.serve(w, req, next)
+	})
+}
+
+func (p *Proxy) serve(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	manager := p.Ring.Manager()
+	localNode := p.Ring.LocalNode()
+
+	// Another node already forwarded this to us, so we're the owner as far
+	// as they know. Don't pass it on again.
+	if forwardedByMember(manager, req) {
+		next.ServeHTTP(w, req)
+		return
+	}
+	req.Header.Del(ForwardedByHeader)
+
+	// Without it we'd forward our own keys back to ourselves
+	if localNode == "" {
+		http.Error(w, `{"status": "error", "message": "Local node unknown"}`, 503)
+		return
+	}
+
+	key, err := p.KeyFn(req)
+	if err != nil {
+		http.Error(w, `{"status": "error", "message": "Invalid key"}`, 400)
+		return
+	}
+
+	nodes, err := manager.GetNodes(key, p.attempts())
+	if err != nil {
+		http.Error(w, `{"status": "error", "message": "Unable to find owner"}`, 503)
+		return
+	}
+
+	body, err := bufferBody(w, req)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, `{"status": "error", "message": "Request body too large"}`, 413)
+			return
+		}
+
+		http.Error(w, `{"status": "error", "message": "Unable to read request body"}`, 400)
+		return
+	}
+
+	for _, node := range nodes {
+		if node == localNode {
+			req.Body = body.reader()
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		err := p.forward(w, req, localNode, node, body)
+		if err == nil {
+			return
+		}
+
+		p.logger.get().Warn("Unable to reach owner", "node", node, "key", key, "error", err)
+
+		if req.Context().Err() != nil {
+			return
+		}
+
+		// The node may have acted on it, so we can't send it again
+		if !isIdempotent(req.Method) && !isDialError(err) {
+			break
+		}
+	}
+
+	http.Error(w, `{"status": "error", "message": "Unable to reach owner"}`, 502)
+}
+
+// forward reverse proxies the request to the node. It returns an error,
+// having written nothing, if the node couldn't be reached.
+func (p *Proxy) forward(w http.ResponseWriter, req *http.Request, localNode string, node string,
+	body *proxyBody) error {
+
+	var proxyErr error
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(out *httputil.ProxyRequest) {
+			out.Out.URL.Scheme = p.scheme()
+			out.Out.URL.Host = node
+			out.Out.Host = node
+			out.Out.Header.Set(ForwardedByHeader, localNode)
+			out.SetXForwarded()
+		},
+		Transport: p.Transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			proxyErr = err
+		},
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.Body = body.reader()
+
+	proxy.ServeHTTP(w, outReq)
+
+	return proxyErr
+}
+
+// forwardedByMember returns true if the request was forwarded by another
+// node in the ring. The ForwardedByHeader must name the node, and the
+// request must come from the node's address, or one of the IPs it resolves
+// to if it is a hostname.
+func forwardedByMember(manager *HashRingManager, req *http.Request) bool {
+	forwardedBy := req.Header.Get(ForwardedByHeader)
+	if forwardedBy == "" {
+		return false
+	}
+
+	snap, err := manager.Snapshot()
+	if err != nil {
+		return false
+	}
+
+	node, ok := snap.Node(forwardedBy)
+	if !ok {
+		return false
+	}
+
+	remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	return hasAddress(req.Context(), node.Address, net.ParseIP(remoteHost))
+}
+
+// hasAddress returns true if the address is the IP, or is a hostname that
+// resolves to it. Some rings, like the DNS and Sidecar rings, can register
+// nodes under their hostnames.
+func hasAddress(ctx context.Context, address string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if addressIP := net.ParseIP(address); addressIP != nil {
+		return addressIP.Equal(ip)
+	}
+
+	resolved, err := net.DefaultResolver.LookupIPAddr(ctx, address)
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range resolved {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isIdempotent returns true for the methods that are safe to send twice.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDialError returns true if the error came from failing to connect, in
+// which case the node never saw the request.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (p *Proxy) attempts() int {
+	if p.Attempts < 1 {
+		return DefaultProxyAttempts
+	}
+
+	return p.Attempts
+}
+
+func (p *Proxy) scheme() string {
+	if p.Scheme == "" {
+		return "http"
+	}
+
+	return p.Scheme
+}
+
+// proxyBody holds a request body in memory, so that it can be sent more than
+// once.
+type proxyBody struct {
+	data []byte
+}
+
+func (b *proxyBody) reader() io.ReadCloser {
+	if b == nil {
+		return http.NoBody
+	}
+
+	return io.NopCloser(bytes.NewReader(b.data))
+}
+
+// bufferBody reads in the whole request body, up to MaxProxyBodySize.
+func bufferBody(w http.ResponseWriter, req *http.Request) (*proxyBody, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MaxProxyBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyBody{data: data}, nil
+}
@@ -0,0 +1,247 @@
+package ringman
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// echoServer returns a server that reports its name, the ForwardedByHeader and
+// the body it was sent
+func echoServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "%s|%s|%s", name, req.Header.Get(ForwardedByHeader), string(body))
+	}))
+}
+
+// hangupServer returns a server that accepts requests and then hangs up
+// without answering them
+func hangupServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+}
+
+// keyOwnedBy finds a key that the node owns in the manager's ring
+func keyOwnedBy(ringMgr *HashRingManager, node string) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner, _ := ringMgr.GetNode(key); owner == node {
+			return key
+		}
+	}
+}
+
+// deadAddress returns an address with nothing listening on it
+func deadAddress() string {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func Test_KeyExtractors(t *testing.T) {
+	Convey("KeyExtractors", t, func() {
+		req := httptest.NewRequest("GET", "/users/1234/profile?key=bocaccio", nil)
+		req.Header.Set("X-Key", "decameron")
+
+		Convey("KeyFromHeader() gets the key from a header", func() {
+			key, err := KeyFromHeader("X-Key")(req)
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "decameron")
+
+			_, err = KeyFromHeader("X-Missing")(req)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("KeyFromQuery() gets the key from a query parameter", func() {
+			key, err := KeyFromQuery("key")(req)
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "bocaccio")
+
+			_, err = KeyFromQuery("missing")(req)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("KeyFromPathSegment() gets the key from the path", func() {
+			key, err := KeyFromPathSegment(1)(req)
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "1234")
+
+			_, err = KeyFromPathSegment(3)(req)
+			So(err, ShouldNotBeNil)
+
+			_, err = KeyFromPathSegment(-1)(req)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_Proxy(t *testing.T) {
+	Convey("Proxy", t, func() {
+		local := echoServer("local")
+		remote := echoServer("remote")
+		localNode := local.Listener.Addr().String()
+		remoteNode := remote.Listener.Addr().String()
+
+		ring, err := NewStaticRing([]string{localNode, remoteNode})
+		So(err, ShouldBeNil)
+		ring.SetLocalNode(localNode)
+		ringMgr := ring.Manager()
+
+		proxy := NewProxy(ring, KeyFromQuery("key"))
+		proxy.SetLogger(&recordingLogger{})
+		handler := proxy.Handler(local.Config.Handler)
+
+		serve := func(req *http.Request) (int, string) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			body, _ := io.ReadAll(recorder.Result().Body)
+			return recorder.Result().StatusCode, string(body)
+		}
+
+		Convey("serves keys owned by the local node itself", func() {
+			key := keyOwnedBy(ringMgr, localNode)
+			status, body := serve(httptest.NewRequest("GET", "/?key="+key, nil))
+
+			So(status, ShouldEqual, 200)
+			So(body, ShouldEqual, "local||")
+		})
+
+		Convey("proxies keys owned by other nodes to the owner", func() {
+			key := keyOwnedBy(ringMgr, remoteNode)
+			status, body := serve(httptest.NewRequest("POST", "/?key="+key, strings.NewReader("hello")))
+
+			So(status, ShouldEqual, 200)
+			So(body, ShouldEqual, "remote|"+localNode+"|hello")
+		})
+
+		Convey("serves requests forwarded by other nodes locally, whoever owns them", func() {
+			key := keyOwnedBy(ringMgr, remoteNode)
+			req := httptest.NewRequest("GET", "/?key="+key, nil)
+			req.RemoteAddr = "127.0.0.1:40000"
+			req.Header.Set(ForwardedByHeader, remoteNode)
+
+			status, body := serve(req)
+
+			So(status, ShouldEqual, 200)
+			So(body, ShouldEqual, "local|"+remoteNode+"|")
+		})
+
+		Convey("ignores the forwarded header from anywhere else", func() {
+			key := keyOwnedBy(ringMgr, remoteNode)
+
+			// Not a node in the ring
+			req := httptest.NewRequest("GET", "/?key="+key, nil)
+			req.RemoteAddr = "127.0.0.1:40000"
+			req.Header.Set(ForwardedByHeader, "somewhere-else:8000")
+
+			status, body := serve(req)
+			So(status, ShouldEqual, 200)
+			So(body, ShouldEqual, "remote|"+localNode+"|")
+
+			// A node in the ring, but not where it came from
+			req = httptest.NewRequest("GET", "/?key="+key, nil)
+			req.RemoteAddr = "192.0.2.1:40000"
+			req.Header.Set(ForwardedByHeader, remoteNode)
+
+			status, body = serve(req)
+			So(status, ShouldEqual, 200)
+			So(body, ShouldEqual, "remote|"+localNode+"|")
+		})
+
+		Convey("trusts a node registered by hostname from the IPs it resolves to", func() {
+			So(ringMgr.AddNodeInfo(Node{ID: "localhost:9000", Address: "localhost", Port: 9000}), ShouldBeNil)
+
+			req := httptest.NewRequest("GET", "/?key=bocaccio", nil)
+			req.RemoteAddr = "127.0.0.1:40000"
+			req.Header.Set(ForwardedByHeader, "localhost:9000")
+			So(forwardedByMember(ringMgr, req), ShouldBeTrue)
+
+			req.RemoteAddr = "192.0.2.1:40000"
+			So(forwardedByMember(ringMgr, req), ShouldBeFalse)
+		})
+
+		Convey("follows changes to the local node", func() {
+			key := keyOwnedBy(ringMgr, localNode)
+			ring.SetLocalNode(remoteNode)
+
+			_, body := serve(httptest.NewRequest("GET", "/?key="+key, nil))
+			So(body, ShouldEqual, "local|"+remoteNode+"|")
+		})
+
+		Convey("tries the next replica when the owner is down", func() {
+			dead := deadAddress()
+			ringMgr.AddNode(dead)
+
+			key := keyOwnedBy(ringMgr, dead)
+			status, body := serve(httptest.NewRequest("POST", "/?key="+key, strings.NewReader("hello")))
+
+			So(status, ShouldEqual, 200)
+			So(body, ShouldEndWith, "|hello")
+		})
+
+		Convey("only resends requests that are safe to send twice", func() {
+			hangup := hangupServer()
+			defer hangup.Close()
+			hangupNode := hangup.Listener.Addr().String()
+			ringMgr.AddNode(hangupNode)
+
+			key := keyOwnedBy(ringMgr, hangupNode)
+
+			status, _ := serve(httptest.NewRequest("POST", "/?key="+key, strings.NewReader("hello")))
+			So(status, ShouldEqual, 502)
+
+			status, body := serve(httptest.NewRequest("GET", "/?key="+key, nil))
+			So(status, ShouldEqual, 200)
+			So(body, ShouldNotBeEmpty)
+		})
+
+		Convey("returns a 503 until it knows the local node", func() {
+			ring.SetLocalNode("")
+
+			status, _ := serve(httptest.NewRequest("GET", "/?key="+keyOwnedBy(ringMgr, localNode), nil))
+			So(status, ShouldEqual, 503)
+
+			status, _ = serve(httptest.NewRequest("GET", "/?key="+keyOwnedBy(ringMgr, remoteNode), nil))
+			So(status, ShouldEqual, 503)
+		})
+
+		Convey("returns a 502 when no replica can be reached", func() {
+			dead := deadAddress()
+			ringMgr.RemoveNode(remoteNode)
+			ringMgr.AddNode(dead)
+			proxy.Attempts = 1
+
+			status, _ := serve(httptest.NewRequest("GET", "/?key="+keyOwnedBy(ringMgr, dead), nil))
+
+			So(status, ShouldEqual, 502)
+		})
+
+		Convey("returns a 400 when there is no key", func() {
+			status, _ := serve(httptest.NewRequest("GET", "/", nil))
+			So(status, ShouldEqual, 400)
+		})
+
+		Convey("returns a 503 when the ring is empty", func() {
+			ringMgr.SetNodes(map[string]int{})
+
+			status, _ := serve(httptest.NewRequest("GET", "/?key=bocaccio", nil))
+			So(status, ShouldEqual, 503)
+		})
+
+		Reset(func() {
+			ring.Shutdown()
+			local.Close()
+			remote.Close()
+		})
+	})
+}
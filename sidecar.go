@@ -1,15 +1,13 @@
 package ringman
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/Nitro/sidecar/catalog"
 	"github.com/Nitro/sidecar/receiver"
 	"github.com/Nitro/sidecar/service"
-	"github.com/relistan/go-director"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -24,15 +22,21 @@ const (
 // subscribe to Sidecar events, however, and uses a Sidecar Receiver to
 // process them.
 type SidecarRing struct {
-	managerLooper director.Looper
-	manager       *HashRingManager
-	sidecarUrl    string
-	svcName       string
-	svcPort       int64
-	rcvr          *receiver.Receiver
-	nodes         map[string]struct{} // Tracking which nodes we already know about
+	managedRing
+	sidecarUrl string
+	svcName    string
+	svcPort    int64
+	rcvr       *receiver.Receiver
+	weightFn   ServiceWeightFunc
+	hostname   string // Our own hostname, unless Sidecar tells us otherwise
 }
 
+// A ServiceWeightFunc returns the weight a Sidecar service should be given in
+// the ring. This lets the weight be derived from whatever the caller knows
+// about the service, e.g. its labels or image. Returning less than 1 gives the
+// node the DefaultNodeWeight.
+type ServiceWeightFunc func(svc *service.Service) int
+
 // Ensure SidecarRing implements Ring interface
 var _ Ring = (*SidecarRing)(nil)
 
@@ -41,17 +45,25 @@ var _ Ring = (*SidecarRing)(nil)
 // ServicePort number passed in. If the SidecarUrl is not empty string,
 // then we will call that address to get initial state on bootstrap.
 func NewSidecarRing(sidecarUrl string, svcName string, svcPort int64) (*SidecarRing, error) {
-	ringMgr := NewHashRingManager([]string{})
-	looper := director.NewFreeLooper(director.FOREVER, nil)
-	go ringMgr.Run(looper)
+	return NewWeightedSidecarRing(sidecarUrl, svcName, svcPort, nil)
+}
+
+// NewWeightedSidecarRing returns a SidecarRing configured like NewSidecarRing
+// does, but which calls weightFn to weight each service in the ring. If
+// weightFn is nil, all nodes get the DefaultNodeWeight.
+func NewWeightedSidecarRing(sidecarUrl string, svcName string, svcPort int64,
+	weightFn ServiceWeightFunc) (*SidecarRing, error) {
+
+	hostname, _ := os.Hostname()
 
 	scRing := &SidecarRing{
-		manager:       ringMgr,
-		managerLooper: looper,
-		sidecarUrl:    sidecarUrl,
-		svcName:       svcName,
-		svcPort:       svcPort,
+		sidecarUrl: sidecarUrl,
+		svcName:    svcName,
+		svcPort:    svcPort,
+		weightFn:   weightFn,
+		hostname:   hostname,
 	}
+	scRing.startManager()
 
 	// Set up the receiver for incoming requests
 	rcvr := receiver.NewReceiver(DefaultReceiverCapacity, scRing.onUpdate)
@@ -73,42 +85,48 @@ func NewSidecarRing(sidecarUrl string, svcName string, svcPort int64) (*SidecarR
 	return scRing, nil
 }
 
-// onUpdate takes care of incoming updates from the receiver
+// onUpdate takes care of incoming updates from the receiver. Our own node
+// is the service running on the same host as the Sidecar that sent them.
 func (r *SidecarRing) onUpdate(state *catalog.ServicesState) {
-	newNodes := make(map[string]struct{}, len(r.nodes)+5) // Likely to be similar length
+	localHost := r.hostname
+	if state.Hostname != "" {
+		localHost = state.Hostname
+	}
+
+	var localNode string
+	var infos []Node
 
 	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
 		if svc.Name == r.svcName && svc.IsAlive() { // Only get ALIVE nodes...
-			key, err := r.keyForService(svc)
+			info, err := r.nodeForService(svc)
 			if err != nil {
-				log.Error(err)
+				r.logger.get().Error("Unable to add service to the ring", "service", svc.ID, "error", err)
 				return
 			}
-			newNodes[key] = struct{}{}
-		}
-	})
+			key := info.ID
+			infos = append(infos, info)
 
-	// Was it it in the new group and not in the old one? Add it.
-	for name := range newNodes {
-		if _, ok := r.nodes[name]; !ok {
-			r.manager.AddNode(name)
+			// If there's more than one of us on the host, pick one consistently
+			if svc.Hostname == localHost && (localNode == "" || key < localNode) {
+				localNode = key
+			}
 		}
-	}
+	})
 
-	// In the old group but not in the new one? Remove it.
-	for name := range r.nodes {
-		if _, ok := newNodes[name]; !ok {
-			r.manager.RemoveNode(name)
-		}
+	// Replace the whole set at once, so the ring is only rebuilt once
+	err := r.manager.SetNodesInfo(infos)
+	if err != nil {
+		r.logger.get().Error("Unable to update ring from Sidecar", "error", err)
+		return
 	}
 
-	// Overwrite the old set
-	r.nodes = newNodes
+	r.setLocalNode(localNode)
 }
 
-// keyForService takes a service and returns the key we use to store it in the
-// hashring. Currently based on the IP address and service port.
-func (r *SidecarRing) keyForService(svc *service.Service) (string, error) {
+// nodeForService takes a service and returns its Node, whose ID is the key we
+// use to store it in the hashring. Currently based on the IP address and
+// service port.
+func (r *SidecarRing) nodeForService(svc *service.Service) (Node, error) {
 	var matched *service.Port
 	for _, port := range svc.Ports {
 		if port.ServicePort == r.svcPort {
@@ -118,7 +136,7 @@ func (r *SidecarRing) keyForService(svc *service.Service) (string, error) {
 	}
 
 	if matched == nil {
-		return "", fmt.Errorf(
+		return Node{}, fmt.Errorf(
 			"Can't match service port %d for incoming service %s!",
 			r.svcPort, svc.ID,
 		)
@@ -131,75 +149,57 @@ func (r *SidecarRing) keyForService(svc *service.Service) (string, error) {
 		key = matched.IP
 	}
 
-	return fmt.Sprintf("%s:%d", key, matched.Port), nil
+	return Node{
+		ID:      fmt.Sprintf("%s:%d", key, matched.Port),
+		Name:    svc.ID,
+		Address: key,
+		Port:    int(matched.Port),
+		Weight:  r.weightForService(svc),
+		Metadata: map[string]string{
+			"service":  svc.Name,
+			"image":    svc.Image,
+			"hostname": svc.Hostname,
+		},
+	}, nil
 }
 
-// HttpListNodesHandler is an http.Handler that will return a JSON-encoded list of
-// the Sidecar nodes in the current ring.
-func (r *SidecarRing) HttpListNodesHandler(w http.ResponseWriter, req *http.Request) {
-	defer req.Body.Close()
-
-	jsonBytes, err := json.MarshalIndent(&r.nodes, "", "  ")
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// weightForService returns the weight to give a service in the ring, using
+// the weightFn if we were configured with one.
+func (r *SidecarRing) weightForService(svc *service.Service) int {
+	if r.weightFn == nil {
+		return DefaultNodeWeight
 	}
 
-	w.Write(jsonBytes)
-}
-
-// HttpGetNodeHandler is an http.Handler that will return an object containing the
-// node that currently owns a specific key.
-func (r *SidecarRing) HttpGetNodeHandler(w http.ResponseWriter, req *http.Request) {
-	defer req.Body.Close()
-
-	key := req.FormValue("key")
-	if key == "" {
-		http.Error(w, `{"status": "error", "message": "Invalid key"}`, 404)
-		return
-	}
-
-	if r == nil {
-		http.Error(w, `{"status": "error", "message": "SidecarRing was nil"}`, 500)
-		return
-	}
-
-	node, _ := r.manager.GetNode(key)
-
-	respObj := struct {
-		Node string
-		Key  string
-	}{node, key}
-
-	jsonBytes, err := json.MarshalIndent(respObj, "", "  ")
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	weight := r.weightFn(svc)
+	if weight < 1 {
+		return DefaultNodeWeight
 	}
 
-	w.Write(jsonBytes)
+	return weight
 }
 
 // HttpMux returns an http.ServeMux configured to run the HTTP handlers on the
-// SidecarRing. You can either use this one, or mount the handlers on a mux of your
-// own choosing (e.g. Gorilla mux or httprouter)
+// SidecarRing, and the /update endpoint Sidecar sends changes to. You can
+// either use this one, or mount the handlers on a mux of your own choosing
+// (e.g. Gorilla mux or httprouter)
+//
+// If NewMetrics was called on the ring's Manager, the mux also serves them
+// from /metrics.
 func (r *SidecarRing) HttpMux() *http.ServeMux {
 	updateHandler := func(w http.ResponseWriter, req *http.Request) {
 		receiver.UpdateHandler(w, req, r.rcvr)
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/nodes/get", r.HttpGetNodeHandler)
-	mux.HandleFunc("/nodes", r.HttpListNodesHandler)
+	mux := r.managedRing.HttpMux()
 	mux.HandleFunc("/update", updateHandler)
-	return mux
-}
 
-func (r *SidecarRing) Manager() *HashRingManager {
-	return r.manager
+	return mux
 }
 
 // Shutdown stops the Receiver and the HashringManager
 func (r *SidecarRing) Shutdown() {
-	r.rcvr.Looper.Quit()
-	r.managerLooper.Quit()
+	r.shutdown(func() {
+		r.rcvr.Looper.Quit()
+		r.stopManager()
+	})
 }
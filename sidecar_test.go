@@ -1,6 +1,7 @@
 package ringman
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -62,6 +63,11 @@ func Test_NewSidecarRing(t *testing.T) {
 			httpmock.DeactivateAndReset()
 		})
 
+		Convey("can be shut down more than once", func() {
+			ring.Shutdown()
+			So(func() { ring.Shutdown() }, ShouldNotPanic)
+		})
+
 		Reset(func() {
 			ring.Shutdown()
 		})
@@ -96,10 +102,21 @@ func Test_onUpdate(t *testing.T) {
 
 		state.AddServiceEntry(svc)
 
+		weights := func() map[string]int {
+			nodes, err := ring.manager.ListNodes()
+			So(err, ShouldBeNil)
+
+			weights := make(map[string]int, len(nodes))
+			for _, node := range nodes {
+				weights[node.ID] = node.Weight
+			}
+			return weights
+		}
+
 		Convey("adds new nodes to the ring", func() {
-			So(len(ring.nodes), ShouldEqual, 0)
+			So(len(weights()), ShouldEqual, 0)
 			ring.onUpdate(state)
-			So(len(ring.nodes), ShouldEqual, 1)
+			So(len(weights()), ShouldEqual, 1)
 
 			node, err := ring.manager.GetNode("anything")
 			So(err, ShouldBeNil)
@@ -118,18 +135,82 @@ func Test_onUpdate(t *testing.T) {
 			state.AddServiceEntry(svc2)
 
 			ring.onUpdate(state)
-			So(len(ring.nodes), ShouldEqual, 2)
+			So(len(weights()), ShouldEqual, 2)
 			ring.onUpdate(catalog.NewServicesState())
-			So(len(ring.nodes), ShouldEqual, 0)
+			So(len(weights()), ShouldEqual, 0)
+
+			// Each update is applied to the ring all at once
+			So(ring.manager.Version(), ShouldEqual, 2)
 
 			node, err := ring.manager.GetNode("anything")
 			So(err.Error(), ShouldContainSubstring, "No nodes in ring")
 			So(node, ShouldEqual, "")
 		})
 
+		Convey("weights nodes using the weight function", func() {
+			ring.weightFn = func(svc *service.Service) int {
+				if svc.ID == "deadbeef123" {
+					return 5
+				}
+				return 0
+			}
+
+			svc2 := service.Service{
+				ID:       "abbaabbaabba",
+				Name:     svcName,
+				Image:    "101deadbeef",
+				Hostname: "some-host",
+				Status:   service.ALIVE,
+				Ports:    []service.Port{{Port: 12345, ServicePort: 9999, IP: "127.0.0.1"}},
+			}
+			state.AddServiceEntry(svc2)
+
+			ring.onUpdate(state)
+			So(weights()["127.0.0.1:23423"], ShouldEqual, 5)
+			So(weights()["127.0.0.1:12345"], ShouldEqual, DefaultNodeWeight)
+		})
+
+		Convey("finds the local node from Sidecar's hostname", func() {
+			So(ring.LocalNode(), ShouldEqual, "")
+			So(ring.IsLocal("anything"), ShouldBeFalse)
+
+			state.Hostname = "some-host"
+			ring.onUpdate(state)
+
+			So(ring.LocalNode(), ShouldEqual, "127.0.0.1:23423")
+			So(ring.IsLocal("anything"), ShouldBeTrue)
+		})
+
+		Convey("falls back to our own hostname for the local node", func() {
+			ring.hostname = "some-host"
+			ring.onUpdate(state)
+			So(ring.LocalNode(), ShouldEqual, "127.0.0.1:23423")
+
+			ring.hostname = "another-host"
+			ring.onUpdate(state)
+			So(ring.LocalNode(), ShouldEqual, "")
+		})
+
+		Convey("keeps the Node for each service", func() {
+			ring.onUpdate(state)
+
+			info, err := ring.manager.GetNodeInfo("anything")
+			So(err, ShouldBeNil)
+			So(info.ID, ShouldEqual, "127.0.0.1:23423")
+			So(info.Name, ShouldEqual, "deadbeef123")
+			So(info.Address, ShouldEqual, "127.0.0.1")
+			So(info.Port, ShouldEqual, 23423)
+			So(info.Metadata["image"], ShouldEqual, "101deadbeef")
+			So(info.Metadata["hostname"], ShouldEqual, "some-host")
+
+			recorder := httptest.NewRecorder()
+			ring.HttpListNodesHandler(recorder, httptest.NewRequest("GET", "/nodes", nil))
+			So(recorder.Body.String(), ShouldContainSubstring, `"Name": "deadbeef123"`)
+		})
+
 		Convey("does not include hosts that are not ALIVE", func() {
 			ring.onUpdate(state)
-			So(len(ring.nodes), ShouldEqual, 1)
+			So(len(weights()), ShouldEqual, 1)
 
 			svc2 := service.Service{
 				ID:       "abbaabbaabba",
@@ -142,7 +223,7 @@ func Test_onUpdate(t *testing.T) {
 			state.AddServiceEntry(svc2)
 
 			ring.onUpdate(state)
-			So(len(ring.nodes), ShouldEqual, 1)
+			So(len(weights()), ShouldEqual, 1)
 
 			node, err := ring.manager.GetNode("anything")
 			So(err, ShouldBeNil)
@@ -198,6 +279,45 @@ func Test_SidecarHttpGetNodeHandler(t *testing.T) {
 			So(body, ShouldContainSubstring, `"Node": "127.0.0.1:23423"`)
 		})
 
+		Convey("returns the ring version with the node", func() {
+			form := url.Values{}
+			form.Set("key", "bocaccio")
+			req.Form = form
+
+			ring.HttpGetNodeHandler(recorder, req)
+
+			bodyBytes, _ := ioutil.ReadAll(recorder.Result().Body)
+			So(string(bodyBytes), ShouldContainSubstring, fmt.Sprintf(`"Version": %d`, ring.Manager().Version()))
+			So(ring.Manager().Version(), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("returns replicas when requested", func() {
+			form := url.Values{}
+			form.Set("key", "bocaccio")
+			form.Set("replicas", "3")
+			req.Form = form
+
+			ring.HttpGetNodeHandler(recorder, req)
+
+			bodyBytes, _ := ioutil.ReadAll(recorder.Result().Body)
+			body := string(bodyBytes)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, `"Nodes": [`)
+			So(body, ShouldContainSubstring, `"127.0.0.1:23423"`)
+		})
+
+		Convey("returns a 400 on an invalid replicas count", func() {
+			form := url.Values{}
+			form.Set("key", "bocaccio")
+			form.Set("replicas", "zero")
+			req.Form = form
+
+			ring.HttpGetNodeHandler(recorder, req)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 400)
+		})
+
 		Reset(func() {
 			ring.Shutdown()
 		})
@@ -0,0 +1,117 @@
+package ringman
+
+import (
+	"strconv"
+)
+
+const (
+	OwnershipSamples = 10000 // How many keys we sample to estimate ownership
+)
+
+// A RingSnapshot is an immutable view of the ring as it was at a specific
+// version. The HashRingManager publishes a new one for each change, and
+// lookups are served from the latest. Holding on to an older snapshot is
+// cheap and is how callers can compare the ring across versions.
+type RingSnapshot struct {
+	Version uint64
+
+	placement   Placement
+	weights     map[string]int
+	totalWeight int // The sum of the weights
+	locations   map[string]Location
+	draining    map[string]bool
+	handoff     Placement       // Includes the draining nodes, nil when there are none
+	nodes       map[string]Node // Every node, draining or not
+}
+
+// newRingSnapshot captures the placement, node weights and locations at the
+// version provided. The maps are copied so the caller is free to keep
+// modifying its own.
+func newRingSnapshot(version uint64, placement Placement, weights map[string]int,
+	locations map[string]Location) *RingSnapshot {
+
+	copiedLocations := make(map[string]Location, len(locations))
+	for node, loc := range locations {
+		copiedLocations[node] = loc
+	}
+
+	var totalWeight int
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+
+	return &RingSnapshot{
+		Version:     version,
+		placement:   placement,
+		weights:     copyWeights(weights),
+		totalWeight: totalWeight,
+		locations:   copiedLocations,
+	}
+}
+
+// Size returns the number of nodes in the ring.
+func (s *RingSnapshot) Size() int {
+	return len(s.weights)
+}
+
+// Weights returns each node in the ring, mapped to its weight.
+func (s *RingSnapshot) Weights() map[string]int {
+	return copyWeights(s.weights)
+}
+
+// GetNode returns the node that owns the key in this version of the ring.
+func (s *RingSnapshot) GetNode(key string) (string, error) {
+	node, ok := s.placement.GetNode(key)
+	if !ok {
+		return "", ErrNoNodes
+	}
+
+	return node, nil
+}
+
+// GetNodes returns up to count distinct nodes for the key in this version of
+// the ring, starting with the node that owns it. When nodes have a Location,
+// the rest are spread across as many zones and racks as possible, taking each
+// in ring order. Otherwise they are simply in ring order.
+func (s *RingSnapshot) GetNodes(key string, count int) ([]string, error) {
+	if count < 1 {
+		return nil, ErrBadCount
+	}
+
+	if len(s.locations) == 0 {
+		nodes, ok := s.placement.GetNodes(key, count)
+		if !ok || len(nodes) == 0 {
+			return nil, ErrNoNodes
+		}
+
+		return nodes, nil
+	}
+
+	// We need the whole ring in order to find the other zones
+	candidates, ok := s.placement.GetNodes(key, len(s.weights))
+	if !ok || len(candidates) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	return spreadLocations(candidates, s.locations, count), nil
+}
+
+// Ownership returns the share of the key space each node owns in this version
+// of the ring, from 0 to 1. The placements don't say how they divide up the
+// key space, so the shares are estimated from OwnershipSamples keys.
+func (s *RingSnapshot) Ownership() map[string]float64 {
+	shares := make(map[string]float64, len(s.weights))
+
+	if len(s.weights) == 0 {
+		return shares
+	}
+
+	for i := 0; i < OwnershipSamples; i++ {
+		node, ok := s.placement.GetNode("ringman-ownership-" + strconv.Itoa(i))
+		if ok {
+			shares[node] += 1.0 / OwnershipSamples
+		}
+	}
+
+	return shares
+}
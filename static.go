@@ -0,0 +1,216 @@
+package ringman
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/relistan/go-director"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultStaticPollInterval = 1 * time.Second // How often a StaticRing checks its file
+)
+
+// A StaticRing is a ring whose members are simply listed, either in code or
+// in a YAML or JSON file. There is no gossip and no health checking, which
+// makes it handy for local development and batch jobs. When the ring comes
+// from a file, the file is watched and changes to it are applied to the ring.
+type StaticRing struct {
+	managedRing
+	watchLooper director.Looper // Only set if we're watching a file
+	path        string
+	lastData    []byte // What we last loaded from the file
+}
+
+// StaticConfig is the contents of a StaticRing's file, e.g.:
+//
+//	nodes:
+//	  - id: 10.0.0.1:8000
+//	    weight: 2
+//	    zone: us-east-1a
+//	  - id: 10.0.0.2:8000
+//	    metadata:
+//	      role: batch
+type StaticConfig struct {
+	Nodes []StaticNode `json:"nodes" yaml:"nodes"`
+}
+
+// A StaticNode is one member of a StaticRing. Only the ID is required, and
+// like the IDs in other rings, it is normally the node's host:port.
+type StaticNode struct {
+	ID       string            `json:"id" yaml:"id"`
+	Name     string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Weight   int               `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Zone     string            `json:"zone,omitempty" yaml:"zone,omitempty"`
+	Rack     string            `json:"rack,omitempty" yaml:"rack,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+// Ensure StaticRing implements Ring interface
+var _ Ring = (*StaticRing)(nil)
+
+// NewStaticRing returns a running StaticRing made up of the nodes provided,
+// each with the DefaultNodeWeight.
+func NewStaticRing(nodes []string) (*StaticRing, error) {
+	config := &StaticConfig{}
+	for _, node := range nodes {
+		config.Nodes = append(config.Nodes, StaticNode{ID: node})
+	}
+
+	ring := newStaticRing()
+
+	err := ring.apply(config)
+	if err != nil {
+		ring.Shutdown()
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+// NewStaticRingFromFile returns a running StaticRing made up of the nodes in
+// the file, which is YAML unless its name ends in .json. The file is checked
+// for changes every interval, or every DefaultStaticPollInterval if interval
+// is 0. If a changed file can't be loaded, or lists no nodes, the error is
+// logged and the ring stays as it was.
+func NewStaticRingFromFile(path string, interval time.Duration) (*StaticRing, error) {
+	if interval <= 0 {
+		interval = DefaultStaticPollInterval
+	}
+
+	ring := newStaticRing()
+	ring.path = path
+
+	_, err := ring.reload()
+	if err != nil {
+		ring.Shutdown()
+		return nil, err
+	}
+
+	looper := director.NewTimedLooper(director.FOREVER, interval, nil)
+	ring.watchLooper = looper
+	go looper.Loop(func() error {
+		if _, err := ring.reload(); err != nil {
+			ring.logger.get().Error("Unable to reload static ring", "path", path, "error", err)
+		}
+		return nil
+	})
+
+	return ring, nil
+}
+
+func newStaticRing() *StaticRing {
+	ring := &StaticRing{}
+	ring.startManager()
+
+	return ring
+}
+
+// reload reads the file and applies it to the ring if it has changed since
+// we last did. It returns true if it did. Only one reload must run at once.
+func (r *StaticRing) reload() (bool, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return false, fmt.Errorf("Unable to read %s: %s", r.path, err)
+	}
+
+	if r.lastData != nil && bytes.Equal(data, r.lastData) {
+		return false, nil
+	}
+
+	config, err := ParseStaticConfig(data, filepath.Ext(r.path) == ".json")
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse %s: %s", r.path, err)
+	}
+
+	err = r.apply(config)
+	if err != nil {
+		return false, err
+	}
+
+	r.logger.get().Info("Loaded static ring", "path", r.path, "nodes", len(config.Nodes),
+		"version", r.manager.Version())
+	r.lastData = data
+
+	return true, nil
+}
+
+// ParseStaticConfig parses the contents of a StaticRing's file, from JSON if
+// isJSON is true, otherwise from YAML. It must list at least one node, so an
+// empty or half written file is never mistaken for an empty ring, and each
+// node must have a distinct ID.
+func ParseStaticConfig(data []byte, isJSON bool) (*StaticConfig, error) {
+	var config StaticConfig
+
+	var err error
+	if isJSON {
+		err = json.Unmarshal(data, &config)
+	} else {
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Nodes) == 0 {
+		return nil, errors.New("No nodes listed!")
+	}
+
+	seen := make(map[string]bool, len(config.Nodes))
+	for i, node := range config.Nodes {
+		if node.ID == "" {
+			return nil, fmt.Errorf("Node %d has no id!", i)
+		}
+
+		if seen[node.ID] {
+			return nil, fmt.Errorf("Node %s is listed more than once!", node.ID)
+		}
+		seen[node.ID] = true
+	}
+
+	return &config, nil
+}
+
+// apply replaces the membership of the ring with the nodes in the config.
+func (r *StaticRing) apply(config *StaticConfig) error {
+	nodes := make([]Node, 0, len(config.Nodes))
+	for _, static := range config.Nodes {
+		node := nodeFromID(static.ID)
+		if static.Name != "" {
+			node.Name = static.Name
+		}
+		node.Weight = static.Weight
+		if node.Weight < 1 {
+			// Left out, or dropped since the last load
+			node.Weight = DefaultNodeWeight
+		}
+		node.Location = Location{Zone: static.Zone, Rack: static.Rack}
+		node.Metadata = static.Metadata
+
+		nodes = append(nodes, node)
+	}
+
+	return r.manager.SetNodesInfo(nodes)
+}
+
+// SetLocalNode tells the ring which of its nodes this one is.
+func (r *StaticRing) SetLocalNode(id string) {
+	r.setLocalNode(id)
+}
+
+// Shutdown stops watching the file, if we were, and stops the HashRingManager
+func (r *StaticRing) Shutdown() {
+	r.shutdown(func() {
+		if r.watchLooper != nil {
+			r.watchLooper.Quit()
+		}
+
+		r.stopManager()
+	})
+}
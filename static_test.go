@@ -0,0 +1,194 @@
+package ringman
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// waitForNodes waits a while for the ring to have count nodes
+func waitForNodes(ring Ring, count int) []Node {
+	var nodes []Node
+	for i := 0; i < 200; i++ {
+		nodes, _ = ring.Manager().ListNodes()
+		if len(nodes) == count {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return nodes
+}
+
+func Test_NewStaticRing(t *testing.T) {
+	Convey("NewStaticRing()", t, func() {
+		ring, err := NewStaticRing([]string{"10.0.0.1:8000", "10.0.0.2:8000"})
+		So(err, ShouldBeNil)
+
+		Convey("builds the ring from the list", func() {
+			nodes, err := ring.Manager().ListNodes()
+			So(err, ShouldBeNil)
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].Address, ShouldEqual, "10.0.0.1")
+			So(nodes[0].Port, ShouldEqual, 8000)
+			So(ring.Manager().Version(), ShouldEqual, 1)
+		})
+
+		Convey("knows its local node once told", func() {
+			So(ring.LocalNode(), ShouldEqual, "")
+			So(ring.IsLocal("bocaccio"), ShouldBeFalse)
+
+			owner, _ := ring.Manager().GetNode("bocaccio")
+			ring.SetLocalNode(owner)
+			So(ring.LocalNode(), ShouldEqual, owner)
+			So(ring.IsLocal("bocaccio"), ShouldBeTrue)
+		})
+
+		Convey("serves the usual HTTP endpoints", func() {
+			recorder := httptest.NewRecorder()
+			ring.HttpMux().ServeHTTP(recorder, httptest.NewRequest("GET", "/nodes/get?key=bocaccio", nil))
+			So(recorder.Result().StatusCode, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, `"Key": "bocaccio"`)
+
+			recorder = httptest.NewRecorder()
+			ring.HttpMux().ServeHTTP(recorder, httptest.NewRequest("GET", "/nodes", nil))
+			So(recorder.Body.String(), ShouldContainSubstring, `"ID": "10.0.0.2:8000"`)
+		})
+
+		Convey("rejects files with duplicate nodes", func() {
+			_, err := ParseStaticConfig([]byte("nodes:\n  - id: a\n  - id: a\n"), false)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("can be shut down more than once", func() {
+			ring.Shutdown()
+			So(func() { ring.Shutdown() }, ShouldNotPanic)
+		})
+
+		Reset(func() {
+			ring.Shutdown()
+		})
+	})
+}
+
+func Test_StaticRingFromFile(t *testing.T) {
+	Convey("NewStaticRingFromFile()", t, func() {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "ring.yaml")
+
+		So(os.WriteFile(path, []byte(`
+nodes:
+  - id: 10.0.0.1:8000
+    name: alpha
+    weight: 2
+    zone: us-east-1a
+    metadata:
+      role: primary
+  - id: 10.0.0.2:8000
+`), 0644), ShouldBeNil)
+
+		ring, err := NewStaticRingFromFile(path, 10*time.Millisecond)
+		So(err, ShouldBeNil)
+		ring.SetLogger(&recordingLogger{})
+
+		Convey("loads the nodes from YAML", func() {
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(nodes[0].Name, ShouldEqual, "alpha")
+			So(nodes[0].Weight, ShouldEqual, 2)
+			So(nodes[0].Location.Zone, ShouldEqual, "us-east-1a")
+			So(nodes[0].Metadata["role"], ShouldEqual, "primary")
+			So(nodes[1].Weight, ShouldEqual, DefaultNodeWeight)
+		})
+
+		Convey("applies changes to the file", func() {
+			So(os.WriteFile(path, []byte("nodes:\n  - id: 10.0.0.3:8000\n"), 0644), ShouldBeNil)
+
+			nodes := waitForNodes(ring, 1)
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.3:8000")
+		})
+
+		Convey("goes back to the default weight when one is dropped from the file", func() {
+			So(os.WriteFile(path, []byte(`
+nodes:
+  - id: 10.0.0.1:8000
+  - id: 10.0.0.2:8000
+  - id: 10.0.0.3:8000
+`), 0644), ShouldBeNil)
+
+			nodes := waitForNodes(ring, 3)
+			So(len(nodes), ShouldEqual, 3)
+			So(nodes[0].ID, ShouldEqual, "10.0.0.1:8000")
+			So(nodes[0].Weight, ShouldEqual, DefaultNodeWeight)
+
+			snap, _ := ring.Manager().Snapshot()
+			So(snap.Weights()["10.0.0.1:8000"], ShouldEqual, DefaultNodeWeight)
+		})
+
+		Convey("keeps the ring as it was when the file is broken", func() {
+			version := ring.Manager().Version()
+			So(os.WriteFile(path, []byte("nodes: [{id: }"), 0644), ShouldBeNil)
+
+			time.Sleep(50 * time.Millisecond)
+
+			nodes, _ := ring.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 2)
+			So(ring.Manager().Version(), ShouldEqual, version)
+		})
+
+		Convey("keeps the ring as it was when the file is empty", func() {
+			version := ring.Manager().Version()
+
+			for _, data := range []string{"", "nodes:\n", "# Being rewritten\n"} {
+				So(os.WriteFile(path, []byte(data), 0644), ShouldBeNil)
+				time.Sleep(50 * time.Millisecond)
+
+				nodes, _ := ring.Manager().ListNodes()
+				So(len(nodes), ShouldEqual, 2)
+				So(ring.Manager().Version(), ShouldEqual, version)
+			}
+
+			// And picks up the file once it's whole again
+			So(os.WriteFile(path, []byte("nodes:\n  - id: 10.0.0.3:8000\n"), 0644), ShouldBeNil)
+			nodes := waitForNodes(ring, 1)
+			So(len(nodes), ShouldEqual, 1)
+		})
+
+		Convey("loads the nodes from JSON", func() {
+			jsonPath := filepath.Join(dir, "ring.json")
+			So(os.WriteFile(jsonPath, []byte(`{"nodes": [{"id": "10.0.0.4:8000", "rack": "r1"}]}`), 0644), ShouldBeNil)
+
+			jsonRing, err := NewStaticRingFromFile(jsonPath, 0)
+			So(err, ShouldBeNil)
+			defer jsonRing.Shutdown()
+
+			nodes, _ := jsonRing.Manager().ListNodes()
+			So(len(nodes), ShouldEqual, 1)
+			So(nodes[0].Location.Rack, ShouldEqual, "r1")
+		})
+
+		Convey("returns an error when the file can't be loaded", func() {
+			_, err := NewStaticRingFromFile(filepath.Join(dir, "missing.yaml"), 0)
+			So(err, ShouldNotBeNil)
+
+			badPath := filepath.Join(dir, "bad.yaml")
+			So(os.WriteFile(badPath, []byte("nodes:\n  - weight: 2\n"), 0644), ShouldBeNil)
+			_, err = NewStaticRingFromFile(badPath, 0)
+			So(err, ShouldNotBeNil)
+
+			emptyPath := filepath.Join(dir, "empty.yaml")
+			So(os.WriteFile(emptyPath, []byte(""), 0644), ShouldBeNil)
+			_, err = NewStaticRingFromFile(emptyPath, 0)
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			ring.Shutdown()
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package ringman
+
+import (
+	"context"
+	"errors"
+)
+
+// A Location describes where a node runs. Replica lookups use it to spread
+// the nodes returned for a key across as many zones, and then racks, as
+// they can. Either field may be left empty if it isn't known.
+type Location struct {
+	Zone string
+	Rack string
+}
+
+// AddNodeWithLocation is a blocking call that adds a node with the weight and
+// Location provided, and waits for it to be applied. If the node is already in
+// the ring, its weight and Location are updated instead.
+func (r *HashRingManager) AddNodeWithLocation(nodeName string, weight int, loc Location) error {
+	return r.AddNodeWithLocationContext(context.Background(), nodeName, weight, loc)
+}
+
+// AddNodeWithLocationContext is like AddNodeWithLocation but gives up when
+// the context is done.
+func (r *HashRingManager) AddNodeWithLocationContext(ctx context.Context, nodeName string,
+	weight int, loc Location) error {
+
+	if weight < 1 {
+		return errors.New("Node weight must be at least 1")
+	}
+
+	return r.sendChange(ctx, RingCommand{
+		Command:  CmdAddNode,
+		NodeName: nodeName,
+		Weight:   weight,
+		Location: &loc,
+	})
+}
+
+// Location returns where the node runs, as of this version of the ring.
+func (s *RingSnapshot) Location(node string) Location {
+	return s.locations[node]
+}
+
+// spreadLocations picks count nodes from the candidates, which must be in
+// ring order. It first takes the earliest node from each zone, then the
+// earliest from each rack within a zone, then whatever is left. The owner of
+// the key is always picked first. Nodes with no zone or rack are never
+// considered to share one with any other node.
+func spreadLocations(candidates []string, locations map[string]Location, count int) []string {
+	if count > len(candidates) {
+		count = len(candidates)
+	}
+
+	byZone := func(node string) string {
+		if zone := locations[node].Zone; zone != "" {
+			return zone
+		}
+		return "node/" + node
+	}
+
+	byRack := func(node string) string {
+		loc := locations[node]
+		if loc.Zone != "" && loc.Rack != "" {
+			return loc.Zone + "/" + loc.Rack
+		}
+		return "node/" + node
+	}
+
+	anything := func(node string) string { return "node/" + node }
+
+	picked := make(map[string]bool, count)
+	nodes := make([]string, 0, count)
+
+	for _, distinct := range []func(string) string{byZone, byRack, anything} {
+		seen := make(map[string]bool, count)
+		for _, node := range nodes {
+			seen[distinct(node)] = true
+		}
+
+		for _, node := range candidates {
+			if len(nodes) == count {
+				return nodes
+			}
+
+			if picked[node] || seen[distinct(node)] {
+				continue
+			}
+
+			picked[node] = true
+			seen[distinct(node)] = true
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
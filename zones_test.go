@@ -0,0 +1,142 @@
+package ringman
+
+import (
+	"fmt"
+	"testing"
+
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// zonedSnapshot returns a snapshot of the nodes provided, where each is
+// mapped to its Location.
+func zonedSnapshot(locations map[string]Location) *RingSnapshot {
+	weights := make(map[string]int, len(locations))
+	for node := range locations {
+		weights[node] = 1
+	}
+
+	return newRingSnapshot(1, NewHashringPlacement(weights), weights, locations)
+}
+
+func zonesOf(snap *RingSnapshot, nodes []string) map[string]bool {
+	zones := make(map[string]bool)
+	for _, node := range nodes {
+		zones[snap.Location(node).Zone] = true
+	}
+
+	return zones
+}
+
+func Test_ZoneAwareReplicas(t *testing.T) {
+	Convey("Replica lookups with zones", t, func() {
+		threeZones := zonedSnapshot(map[string]Location{
+			"njal":     {Zone: "a"},
+			"skarp":    {Zone: "a"},
+			"kjartan":  {Zone: "b"},
+			"bolli":    {Zone: "b"},
+			"gunnar":   {Zone: "c"},
+			"hallgerd": {Zone: "c"},
+		})
+
+		Convey("put each replica in a different zone", func() {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				nodes, err := threeZones.GetNodes(key, 3)
+				So(err, ShouldBeNil)
+				So(len(nodes), ShouldEqual, 3)
+				So(len(zonesOf(threeZones, nodes)), ShouldEqual, 3)
+			}
+		})
+
+		Convey("keep the owner first", func() {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				owner, _ := threeZones.GetNode(key)
+				nodes, _ := threeZones.GetNodes(key, 2)
+				So(nodes[0], ShouldEqual, owner)
+			}
+		})
+
+		Convey("fill in from zones already used when there are too few", func() {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				nodes, err := threeZones.GetNodes(key, 5)
+				So(err, ShouldBeNil)
+				So(len(nodes), ShouldEqual, 5)
+				So(len(zonesOf(threeZones, nodes[:3])), ShouldEqual, 3)
+
+				all, _ := threeZones.GetNodes(key, 10)
+				So(len(all), ShouldEqual, 6)
+			}
+		})
+
+		Convey("spread across racks within a zone", func() {
+			racks := zonedSnapshot(map[string]Location{
+				"njal":    {Zone: "a", Rack: "1"},
+				"skarp":   {Zone: "a", Rack: "1"},
+				"kjartan": {Zone: "a", Rack: "2"},
+			})
+
+			for i := 0; i < 100; i++ {
+				nodes, _ := racks.GetNodes(fmt.Sprintf("key-%d", i), 2)
+				So(racks.Location(nodes[0]).Rack, ShouldNotEqual, racks.Location(nodes[1]).Rack)
+			}
+		})
+
+		Convey("treat nodes without a zone as their own", func() {
+			mixed := zonedSnapshot(map[string]Location{
+				"njal":    {Zone: "a"},
+				"skarp":   {Zone: "a"},
+				"kjartan": {},
+			})
+
+			for i := 0; i < 100; i++ {
+				nodes, _ := mixed.GetNodes(fmt.Sprintf("key-%d", i), 2)
+				So(nodes, ShouldContain, "kjartan")
+			}
+		})
+	})
+
+	Convey("HashRingManager tracks node locations", t, func() {
+		ringMgr := NewHashRingManager([]string{})
+		go ringMgr.Run(director.NewFreeLooper(director.FOREVER, nil))
+		So(ringMgr.Ping(), ShouldBeTrue)
+
+		So(ringMgr.AddNodeWithLocation("njal", 0, Location{Zone: "a"}), ShouldNotBeNil)
+
+		ringMgr.AddNodeWithLocation("njal", 1, Location{Zone: "a"})
+		ringMgr.AddNodeWithLocation("skarp", 1, Location{Zone: "a"})
+		ringMgr.AddNodeWithLocation("kjartan", 1, Location{Zone: "b"})
+
+		nodes, err := ringMgr.GetNodes("foo", 2)
+		So(err, ShouldBeNil)
+		So(nodes, ShouldContain, "kjartan")
+
+		Convey("a plain add leaves the location alone", func() {
+			ringMgr.AddWeightedNode("kjartan", 3)
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Location("kjartan").Zone, ShouldEqual, "b")
+		})
+
+		Convey("a location change is a new version", func() {
+			before, _ := ringMgr.Snapshot()
+			ringMgr.AddNodeWithLocation("kjartan", 1, Location{Zone: "c"})
+
+			after, _ := ringMgr.Snapshot()
+			So(after.Version, ShouldEqual, before.Version+1)
+			So(after.Location("kjartan").Zone, ShouldEqual, "c")
+		})
+
+		Convey("removing a node forgets its location", func() {
+			ringMgr.RemoveNode("kjartan")
+			ringMgr.AddNode("kjartan")
+
+			snap, _ := ringMgr.Snapshot()
+			So(snap.Location("kjartan"), ShouldResemble, Location{})
+		})
+
+		Reset(func() { ringMgr.Stop() })
+	})
+}